@@ -0,0 +1,105 @@
+package gptease
+
+import (
+	"fmt"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// ToolInvocation is a call to a tool made by the AI, along with its output.
+type ToolInvocation struct {
+	Name      string
+	Arguments string
+	Output    string
+}
+
+// RunUntilTool adds a message from the user to the dialogue, and keeps the
+// conversation going, invoking tools as requested, until the AI calls the
+// tool named stopTool, such as a "done" or "submit" tool. This is a common
+// way to let an agent work on a task until it decides it's finished. The
+// stop tool must be one of the tools of the chat, and is invoked like any
+// other, so its handler can receive the final result. The invocations of all
+// tools are returned in order, with that of the stop tool last, unless it
+// was called along with other tools in the same round.
+//
+// Should the AI respond without calling any tool, it's told to continue, and
+// to call the stop tool when done. Each request to the API counts as a
+// round, and if the stop tool hasn't been called after maxRounds rounds, the
+// invocations so far are returned with an error wrapping ErrMaxRounds.
+// Responses are handled as by Exchange otherwise, so FailOnTokenLimit and
+// RetryEmptyResponses apply, with retries counting as rounds.
+//
+// Unlike Exchange, the dialogue is kept if there's an error, so that the
+// conversation can be inspected or continued.
+func (c *Chat) RunUntilTool(content, stopTool string, maxRounds int) ([]ToolInvocation, error) {
+	defer c.watchDialogue()()
+	if content == "" {
+		return nil, fmt.Errorf("empty content")
+	}
+	if findTool(stopTool, c.Tools) == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTool, stopTool)
+	}
+	if c.pending != nil {
+		return nil, fmt.Errorf("a tool call is awaiting approval, call Resume first")
+	}
+	c.addDefaultInstruction()
+	c.UserSaid(content)
+	c.startTurn()
+	var opts = c.options()
+	var invocations []ToolInvocation
+	var emptyRetries int
+	for round := 0; round < maxRounds; round++ {
+		resp, _, err := c.complete(&opts)
+		if err != nil {
+			return invocations, err
+		}
+		// A tool choice set by ForceTool only applies to the first round.
+		opts.toolChoice = nil
+		var msg = resp.Choices[0].Message
+		switch resp.Choices[0].FinishReason {
+		case openai.FinishReasonContentFilter:
+			metrics.IncErrors("content_filter")
+			return invocations, ErrContentFilter
+		case openai.FinishReasonNull:
+			metrics.IncErrors("not_finished")
+			return invocations, ErrNotFinished
+		case openai.FinishReasonLength:
+			if c.FailOnTokenLimit {
+				metrics.IncErrors("token_limit")
+				return invocations, ErrTokenLimit
+			}
+		case openai.FinishReasonStop:
+			if msg.Content == "" && emptyRetries < c.RetryEmptyResponses {
+				emptyRetries++
+				continue
+			}
+		}
+		c.Dialogue = append(c.Dialogue, msg)
+		if len(msg.ToolCalls) == 0 {
+			c.UserSaid(fmt.Sprintf("Continue, and call %s once you're done.", stopTool))
+			continue
+		}
+		c.toolRounds++
+		if msg.Content != "" && c.OnNarration != nil {
+			c.OnNarration(msg.Content)
+		}
+		var start = len(c.Dialogue)
+		err = c.runTools(msg.ToolCalls, &opts)
+		// Each tool that has run has added its output to the dialogue, in
+		// the order called.
+		var stopped bool
+		for i, m := range c.Dialogue[start:] {
+			var call = msg.ToolCalls[i]
+			invocations = append(invocations, ToolInvocation{
+				Name:      call.Function.Name,
+				Arguments: call.Function.Arguments,
+				Output:    m.Content,
+			})
+			stopped = stopped || call.Function.Name == stopTool
+		}
+		if err != nil || stopped {
+			return invocations, err
+		}
+	}
+	return invocations, fmt.Errorf("%w: %d", ErrMaxRounds, maxRounds)
+}
@@ -0,0 +1,77 @@
+package gptease_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Volumental/gptease"
+)
+
+func TestRunUntilTool(t *testing.T) {
+	var api = newFakeAPI(t,
+		`{"choices": [{"message": {"role": "assistant", "tool_calls": [
+			{"id": "call_1", "type": "function", "function": {"name": "search", "arguments": "{\"q\": \"eggs\"}"}}
+		]}, "finish_reason": "tool_calls"}]}`,
+		`{"choices": [{"message": {"role": "assistant", "content": "I found a recipe."}, "finish_reason": "stop"}]}`,
+		`{"choices": [{"message": {"role": "assistant", "tool_calls": [
+			{"id": "call_2", "type": "function", "function": {"name": "done", "arguments": "{\"answer\": \"scramble\"}"}}
+		]}, "finish_reason": "tool_calls"}]}`,
+	)
+	var tools = []gptease.Tool{{
+		Name:       "search",
+		Parameters: `{"type": "object"}`,
+		Handler:    func(string) (string, error) { return "recipe", nil },
+	}, {
+		Name:       "done",
+		Parameters: `{"type": "object"}`,
+		Handler:    func(string) (string, error) { return "ok", nil },
+	}}
+	var chat = gptease.Chat{Tools: tools}
+	if err := chat.ForceTool("search"); err != nil {
+		t.Fatalf("ForceTool() error = %v", err)
+	}
+	invocations, err := chat.RunUntilTool("Find out how to cook eggs.", "done", 5)
+	if err != nil {
+		t.Fatalf("RunUntilTool() error = %v", err)
+	}
+	var want = []gptease.ToolInvocation{
+		{Name: "search", Arguments: `{"q": "eggs"}`, Output: "recipe"},
+		{Name: "done", Arguments: `{"answer": "scramble"}`, Output: "ok"},
+	}
+	if len(invocations) != len(want) || invocations[0] != want[0] || invocations[1] != want[1] {
+		t.Errorf("RunUntilTool() = %+v, want %+v", invocations, want)
+	}
+	if len(api.requests) != 3 {
+		t.Fatalf("made %d requests, want 3", len(api.requests))
+	}
+	if _, ok := api.requests[0]["tool_choice"]; !ok {
+		t.Errorf("first round has no tool_choice, want the forced tool")
+	}
+	for i, req := range api.requests[1:] {
+		if got, ok := req["tool_choice"]; ok {
+			t.Errorf("round %d tool_choice = %v, want none", i+2, got)
+		}
+	}
+
+	newFakeAPI(t,
+		`{"choices": [{"message": {"role": "assistant", "content": "Hmm."}, "finish_reason": "stop"}]}`,
+		`{"choices": [{"message": {"role": "assistant", "content": "Hmm."}, "finish_reason": "stop"}]}`,
+	)
+	chat = gptease.Chat{Tools: tools}
+	if _, err := chat.RunUntilTool("Find out how to cook eggs.", "done", 2); !errors.Is(err, gptease.ErrMaxRounds) {
+		t.Errorf("RunUntilTool() error = %v, want %v", err, gptease.ErrMaxRounds)
+	}
+
+	// Empty responses are retried, and a response cut off fails if asked to.
+	api = newFakeAPI(t,
+		`{"choices": [{"message": {"role": "assistant", "content": ""}, "finish_reason": "stop"}]}`,
+		`{"choices": [{"message": {"role": "assistant", "content": "Hmm, let me"}, "finish_reason": "length"}]}`,
+	)
+	chat = gptease.Chat{Tools: tools, RetryEmptyResponses: 1, FailOnTokenLimit: true}
+	if _, err := chat.RunUntilTool("Find out how to cook eggs.", "done", 5); !errors.Is(err, gptease.ErrTokenLimit) {
+		t.Errorf("RunUntilTool() error = %v, want %v", err, gptease.ErrTokenLimit)
+	}
+	if len(api.requests) != 2 || len(chat.Dialogue) != 1 {
+		t.Errorf("made %d requests, Dialogue = %q, want 2 and only the message", len(api.requests), contents(chat.Dialogue))
+	}
+}
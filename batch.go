@@ -0,0 +1,274 @@
+package gptease
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// BatchExchange sends a number of independent prompts to the AI, each in a
+// fresh Chat with the given tweaks, and returns the responses in the same
+// order as the prompts. At most concurrency prompts are processed at a time.
+//
+// Errors are collected per prompt, so that one failing prompt doesn't affect
+// the others. Use SetDefaultRateLimiter to stay within your rate limits.
+func BatchExchange(prompts []string, concurrency int, tweaks ChatTweaks) ([]string, []error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var (
+		responses = make([]string, len(prompts))
+		errs      = make([]error, len(prompts))
+		next      = make(chan int)
+		wg        sync.WaitGroup
+	)
+	for w := 0; w < concurrency && w < len(prompts); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				var chat = Chat{Tweaks: tweaks}
+				responses[i], errs[i] = chat.Exchange(prompts[i])
+			}
+		}()
+	}
+	for i := range prompts {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return responses, errs
+}
+
+// BatchJob is a set of chat completion requests to be processed by OpenAI's
+// Batch API. It's suitable for large jobs that don't need an immediate
+// answer, and costs half as much as making the requests one by one. Results
+// are typically available within minutes or hours, but may take up to 24
+// hours.
+//
+// Add the requests with Add, and send them off with Submit. Then wait for
+// the job to complete, and get the results with Results.
+//
+// Note that only a single completion is made for each request, so the AI
+// can't make use of any tools. The Batch API requires a client created by
+// this package, see NewClient.
+type BatchJob struct {
+	// ID identifies the batch job once it's been submitted. A job can be
+	// resumed later by creating a BatchJob with the same ID.
+	ID string
+
+	lines  []byte
+	status batchObject
+}
+
+// BatchStatus describes the progress of a batch job.
+type BatchStatus struct {
+	// Status is one of "validating", "failed", "in_progress", "finalizing",
+	// "completed", "expired", "cancelling" and "cancelled".
+	Status    string
+	Total     int
+	Completed int
+	Failed    int
+}
+
+// Done reports whether the batch job has stopped processing requests.
+func (s BatchStatus) Done() bool {
+	switch s.Status {
+	case "failed", "completed", "expired", "cancelled":
+		return true
+	}
+	return false
+}
+
+// BatchResult is the result of one of the requests in a batch job.
+type BatchResult struct {
+	Response string
+	Err      error
+}
+
+type batchObject struct {
+	ID            string `json:"id"`
+	Status        string `json:"status"`
+	OutputFileID  string `json:"output_file_id"`
+	ErrorFileID   string `json:"error_file_id"`
+	RequestCounts struct {
+		Total     int `json:"total"`
+		Completed int `json:"completed"`
+		Failed    int `json:"failed"`
+	} `json:"request_counts"`
+}
+
+// Add adds a request to the batch job, asking the AI to respond to the
+// dialogue of chat, with its model, tweaks and other settings such as Extra
+// and Prediction, as well as the DefaultInstruction unless disabled. The
+// customID is used to identify the result, and must be unique within the
+// job.
+func (b *BatchJob) Add(customID string, chat *Chat) error {
+	tweaks, err := chat.Tweaks.check()
+	if err != nil {
+		return err
+	}
+	var opts = chat.options()
+	opts.tools = nil
+	opts.defaultInstruction = true
+	var req = chat.request(&opts, tweaks)
+	// Apply what our transport would, had the request been made directly.
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if hasFiles(req.Messages) {
+		if body, err = rewriteFileParts(body); err != nil {
+			return err
+		}
+	}
+	if body, err = setFields(body, opts.fields, opts.extra); err != nil {
+		return err
+	}
+	line, err := json.Marshal(map[string]any{
+		"custom_id": customID,
+		"method":    "POST",
+		"url":       "/v1/chat/completions",
+		"body":      json.RawMessage(body),
+	})
+	if err != nil {
+		return err
+	}
+	b.lines = append(append(b.lines, line...), '\n')
+	return nil
+}
+
+// Submit uploads the requests of the batch job, and starts processing them.
+func (b *BatchJob) Submit() error {
+	if b.ID != "" {
+		return fmt.Errorf("batch job already submitted")
+	}
+	if len(b.lines) == 0 {
+		return fmt.Errorf("empty batch job")
+	}
+	client, err := DefaultClient()
+	if err != nil {
+		return err
+	}
+	var ctx = context.Background()
+	file, err := client.CreateFileBytes(ctx, openai.FileBytesRequest{
+		Name:    "batch.jsonl",
+		Bytes:   b.lines,
+		Purpose: "batch",
+	})
+	if err != nil {
+		return err
+	}
+	var req = map[string]string{
+		"input_file_id":     file.ID,
+		"endpoint":          "/v1/chat/completions",
+		"completion_window": "24h",
+	}
+	if err := apiRequest(ctx, client, http.MethodPost, "/batches", req, &b.status); err != nil {
+		return err
+	}
+	b.ID = b.status.ID
+	return nil
+}
+
+// Status fetches the current status of the batch job.
+func (b *BatchJob) Status() (BatchStatus, error) {
+	if b.ID == "" {
+		return BatchStatus{}, fmt.Errorf("batch job not submitted")
+	}
+	client, err := DefaultClient()
+	if err != nil {
+		return BatchStatus{}, err
+	}
+	if err := apiRequest(context.Background(), client, http.MethodGet, "/batches/"+b.ID, nil, &b.status); err != nil {
+		return BatchStatus{}, err
+	}
+	return BatchStatus{
+		Status:    b.status.Status,
+		Total:     b.status.RequestCounts.Total,
+		Completed: b.status.RequestCounts.Completed,
+		Failed:    b.status.RequestCounts.Failed,
+	}, nil
+}
+
+// Wait polls the status of the batch job at the given interval, until it's
+// done. It returns the final status.
+func (b *BatchJob) Wait(interval time.Duration) (BatchStatus, error) {
+	for {
+		s, err := b.Status()
+		if err != nil || s.Done() {
+			return s, err
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Results downloads the results of a completed batch job, mapping the
+// custom id of each request to its result.
+func (b *BatchJob) Results() (map[string]BatchResult, error) {
+	s, err := b.Status()
+	if err != nil {
+		return nil, err
+	}
+	if !s.Done() {
+		return nil, fmt.Errorf("batch job %s", s.Status)
+	}
+	client, err := DefaultClient()
+	if err != nil {
+		return nil, err
+	}
+	var results = map[string]BatchResult{}
+	for _, id := range []string{b.status.OutputFileID, b.status.ErrorFileID} {
+		if id == "" {
+			continue
+		}
+		if err := readBatchResults(client, id, results); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+func readBatchResults(client *openai.Client, fileID string, results map[string]BatchResult) error {
+	content, err := client.GetFileContent(context.Background(), fileID)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	var dec = json.NewDecoder(content)
+	for {
+		var line struct {
+			CustomID string `json:"custom_id"`
+			Response *struct {
+				StatusCode int                           `json:"status_code"`
+				Body       openai.ChatCompletionResponse `json:"body"`
+			} `json:"response"`
+			Error *openai.APIError `json:"error"`
+		}
+		if err := dec.Decode(&line); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var r BatchResult
+		switch {
+		case line.Error != nil:
+			r.Err = line.Error
+		case line.Response == nil:
+			r.Err = fmt.Errorf("%w: no response in batch result", ErrUnexpectedResponse)
+		case line.Response.StatusCode != http.StatusOK:
+			r.Err = fmt.Errorf("%w: status code %d", ErrUnexpectedResponse, line.Response.StatusCode)
+		case len(line.Response.Body.Choices) == 0:
+			r.Err = fmt.Errorf("%w: OpenAI API returned no choices", ErrUnexpectedResponse)
+		default:
+			r.Response = line.Response.Body.Choices[0].Message.Content
+		}
+		results[line.CustomID] = r
+	}
+}
@@ -0,0 +1,137 @@
+package gptease_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Volumental/gptease"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestBatchExchange(t *testing.T) {
+	var srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req openai.ChatCompletionRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		var prompt = req.Messages[len(req.Messages)-1].Content
+		if prompt == "fail" {
+			http.Error(w, `{"error": {"message": "bad prompt"}}`, http.StatusBadRequest)
+			return
+		}
+		_, _ = io.WriteString(w, `{"choices": [{"message": {"role": "assistant", "content": "re: `+prompt+`"}, "finish_reason": "stop"}]}`)
+	}))
+	defer srv.Close()
+	var config = openai.DefaultConfig("test")
+	config.BaseURL = srv.URL + "/v1"
+	gptease.SetDefaultClient(gptease.NewClientWithConfig(config))
+
+	var prompts = []string{"one", "fail", "three", "four", "five"}
+	responses, errs := gptease.BatchExchange(prompts, 3, gptease.ChatTweaks{})
+	if len(responses) != len(prompts) || len(errs) != len(prompts) {
+		t.Fatalf("BatchExchange() returned %d responses and %d errors, want %d", len(responses), len(errs), len(prompts))
+	}
+	for i, p := range prompts {
+		if p == "fail" {
+			if errs[i] == nil || responses[i] != "" {
+				t.Errorf("prompt %d = %q, %v, want an error", i, responses[i], errs[i])
+			}
+		} else if errs[i] != nil || responses[i] != "re: "+p {
+			t.Errorf("prompt %d = %q, %v, want %q", i, responses[i], errs[i], "re: "+p)
+		}
+	}
+}
+
+func TestBatchJob(t *testing.T) {
+	var uploaded string
+	var mux = http.NewServeMux()
+	mux.HandleFunc("/v1/files", func(w http.ResponseWriter, r *http.Request) {
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			t.Errorf("upload: %v", err)
+			return
+		}
+		b, _ := io.ReadAll(f)
+		uploaded = string(b)
+		_, _ = io.WriteString(w, `{"id": "file-in"}`)
+	})
+	mux.HandleFunc("/v1/batches", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("create batch method = %s, want POST", r.Method)
+		}
+		_, _ = io.WriteString(w, `{"id": "batch-1", "status": "validating"}`)
+	})
+	mux.HandleFunc("/v1/batches/batch-1", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{
+			"id": "batch-1",
+			"status": "completed",
+			"output_file_id": "file-out",
+			"request_counts": {"total": 2, "completed": 1, "failed": 1}
+		}`)
+	})
+	mux.HandleFunc("/v1/files/file-out/content", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"custom_id": "a", "response": {"status_code": 200, "body": {"choices": [{"message": {"role": "assistant", "content": "Ahoy"}}]}}}
+{"custom_id": "b", "error": {"message": "failed"}}
+`)
+	})
+	var srv = httptest.NewServer(mux)
+	defer srv.Close()
+	var config = openai.DefaultConfig("test")
+	config.BaseURL = srv.URL + "/v1"
+	gptease.SetDefaultClient(gptease.NewClientWithConfig(config))
+
+	gptease.DefaultInstruction = "Be brief."
+	t.Cleanup(func() { gptease.DefaultInstruction = "" })
+	var job gptease.BatchJob
+	for _, id := range []string{"a", "b"} {
+		var chat = gptease.Chat{Extra: map[string]any{"store": true}, Prediction: "Hi"}
+		chat.UserSaid("Hello " + id)
+		if err := job.Add(id, &chat); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	if err := job.Submit(); err != nil {
+		t.Fatalf("Submit() error = %v", err)
+	}
+	if job.ID != "batch-1" {
+		t.Errorf("ID = %q, want %q", job.ID, "batch-1")
+	}
+	if n := strings.Count(uploaded, "\n"); n != 2 || !strings.Contains(uploaded, `"custom_id":"a"`) {
+		t.Errorf("uploaded %q, want two requests", uploaded)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(uploaded), "\n") {
+		var req struct {
+			Body struct {
+				Model      string                         `json:"model"`
+				Messages   []openai.ChatCompletionMessage `json:"messages"`
+				Store      bool                           `json:"store"`
+				Prediction map[string]any                 `json:"prediction"`
+			} `json:"body"`
+		}
+		if err := json.Unmarshal([]byte(line), &req); err != nil || req.Body.Model != gptease.DEFAULT_CHAT_MODEL {
+			t.Errorf("uploaded model = %q, %v, want %q", req.Body.Model, err, gptease.DEFAULT_CHAT_MODEL)
+		}
+		if !req.Body.Store || req.Body.Prediction["content"] != "Hi" {
+			t.Errorf("uploaded store = %v, prediction = %v, want the settings of the chat", req.Body.Store, req.Body.Prediction)
+		}
+		if len(req.Body.Messages) != 2 || req.Body.Messages[0].Content != "Be brief." {
+			t.Errorf("uploaded messages = %+v, want the default instruction first", req.Body.Messages)
+		}
+	}
+	s, err := job.Wait(0)
+	if err != nil || s.Status != "completed" || s.Failed != 1 {
+		t.Fatalf("Wait() = %+v, %v", s, err)
+	}
+	results, err := job.Results()
+	if err != nil {
+		t.Fatalf("Results() error = %v", err)
+	}
+	if r := results["a"]; r.Response != "Ahoy" || r.Err != nil {
+		t.Errorf("result a = %+v, want Ahoy", r)
+	}
+	if r := results["b"]; r.Err == nil {
+		t.Errorf("result b = %+v, want error", r)
+	}
+}
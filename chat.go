@@ -2,23 +2,94 @@ package gptease
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
 
 	openai "github.com/sashabaranov/go-openai"
 )
 
 const DEFAULT_CHAT_MODEL = openai.GPT4TurboPreview
 
+// DefaultInstruction, if set, is added as a system message at the start of
+// the dialogue of every Chat that doesn't begin with an instruction of its
+// own when it starts talking. It's a convenient way to give all Chats in an
+// application the same baseline prompt.
+//
+// A Chat can override it by calling Instruction before talking, or disable
+// it by setting NoDefaultInstruction.
+var DefaultInstruction string
+
 var (
 	ErrContentFilter      = errors.New("response omitted due to content filter")
 	ErrNotFinished        = errors.New("response generation not finished")
+	ErrRefusal            = errors.New("model refused to respond")
 	ErrTokenLimit         = errors.New("token limit reached")
+	ErrUnknownTool        = errors.New("unknown tool")
+	ErrBudgetExceeded     = errors.New("conversation token budget exceeded")
+	ErrApprovalRequired   = errors.New("tool call requires approval")
+	ErrMaxRounds          = errors.New("maximum number of rounds reached")
+	ErrToolTimeout        = errors.New("tool timed out")
+	ErrModelOverloaded    = errors.New("model overloaded")
 	ErrUnexpectedResponse = errors.New("unexpected response from OpenAI API")
 )
 
 type Dialogue []openai.ChatCompletionMessage
 
+// ChatMessageRoleNote is the role of notes in the dialogue, which are kept
+// for your own use and never sent to the AI. See Chat.Note.
+const ChatMessageRoleNote = "note"
+
+// IsToolCall reports whether the message is from the AI, asking for one or
+// more tools to be called.
+func IsToolCall(msg openai.ChatCompletionMessage) bool {
+	return msg.Role == openai.ChatMessageRoleAssistant && len(msg.ToolCalls) > 0
+}
+
+// ToolCallsOf returns the tool calls of a message from the AI, if any.
+func ToolCallsOf(msg openai.ChatCompletionMessage) []openai.ToolCall {
+	if !IsToolCall(msg) {
+		return nil
+	}
+	return msg.ToolCalls
+}
+
+// rawResponse holds the parts of a chat completion response that go-openai
+// doesn't parse for us.
+type rawResponse struct {
+	Choices []struct {
+		Message struct {
+			Refusal     string       `json:"refusal"`
+			Annotations []Annotation `json:"annotations"`
+		} `json:"message"`
+	} `json:"choices"`
+}
+
+// Annotation is a note attached to a response, such as a citation of a web
+// page that was used to generate it.
+type Annotation struct {
+	// Type is the kind of annotation, such as "url_citation".
+	Type        string       `json:"type"`
+	URLCitation *URLCitation `json:"url_citation,omitempty"`
+}
+
+// URLCitation refers to a web page that was used to generate part of a
+// response. The indices are the range of characters in the response it
+// applies to.
+type URLCitation struct {
+	StartIndex int    `json:"start_index"`
+	EndIndex   int    `json:"end_index"`
+	Title      string `json:"title"`
+	URL        string `json:"url"`
+}
+
 // ChatTweaks contains parameters that can be changed to alter the behavior of
 // the AI, such as how random the responses should be. If parameters are not
 // set, default values will be used by the API.
@@ -43,6 +114,118 @@ type ChatTweaks struct {
 	//
 	// We generally recommend altering this or temperature but not both.
 	TopP float32
+
+	// PresencePenalty sets the corresponding parameter in the API call to
+	// OpenAI, documented as follows:
+	//
+	// Number between -2.0 and 2.0. Positive values penalize new tokens based
+	// on whether they appear in the text so far, increasing the model's
+	// likelihood to talk about new topics.
+	PresencePenalty float32
+
+	// FrequencyPenalty sets the corresponding parameter in the API call to
+	// OpenAI, documented as follows:
+	//
+	// Number between -2.0 and 2.0. Positive values penalize new tokens based
+	// on their existing frequency in the text so far, decreasing the model's
+	// likelihood to repeat the same line verbatim.
+	FrequencyPenalty float32
+
+	// Seed sets the corresponding parameter in the API call to OpenAI,
+	// documented as follows:
+	//
+	// If specified, our system will make a best effort to sample
+	// deterministically, such that repeated requests with the same seed and
+	// parameters should return the same result. Determinism is not
+	// guaranteed, and you should refer to the system_fingerprint response
+	// parameter to monitor changes in the backend.
+	//
+	// See also Chat.ReproducibilityInfo.
+	Seed *int
+
+	// LogitBias sets the corresponding parameter in the API call to OpenAI,
+	// documented as follows:
+	//
+	// Modify the likelihood of specified tokens appearing in the completion.
+	// Accepts a JSON object that maps tokens (specified by their token ID in
+	// the tokenizer) to an associated bias value from -100 to 100.
+	//
+	// See Chat.BiasWords for setting it by word rather than token id.
+	LogitBias map[string]int
+
+	// LogProbs sets the corresponding parameter in the API call to OpenAI,
+	// documented as follows:
+	//
+	// Whether to return log probabilities of the output tokens or not. If
+	// true, returns the log probabilities of each output token returned in
+	// the content of message.
+	//
+	// See Chat.LastConfidence for making use of them. They aren't returned
+	// for streamed responses.
+	LogProbs bool
+
+	// MaxTokens sets the corresponding parameter in the API call to OpenAI,
+	// documented as follows:
+	//
+	// The maximum number of tokens that can be generated in the chat
+	// completion.
+	//
+	// Zero leaves it to the API. A response reaching the limit is cut off,
+	// and returned as is unless Chat.FailOnTokenLimit is set.
+	MaxTokens int
+
+	// Stop sets the corresponding parameter in the API call to OpenAI,
+	// documented as follows:
+	//
+	// Up to 4 sequences where the API will stop generating further tokens.
+	//
+	// The response is returned as usual when stopped by a stop sequence,
+	// without the sequence itself. More than 4 sequences make Talk fail
+	// without making a request.
+	Stop []string
+
+	// Clamp makes Temperature, TopP and the penalties be clamped to their
+	// valid ranges, 0 to 2, 0 to 1 and -2 to 2, respectively. Otherwise,
+	// values out of range make Talk fail without making a request.
+	Clamp bool
+}
+
+// maxStopSequences is the maximum number of stop sequences the API accepts.
+const maxStopSequences = 4
+
+// check checks that the tweaks are valid, and returns them with any values
+// out of range clamped if Clamp is set.
+func (t ChatTweaks) check() (ChatTweaks, error) {
+	var clamp = func(name string, v *float32, min, max float32) error {
+		if *v >= min && *v <= max {
+			return nil
+		}
+		if !t.Clamp {
+			return fmt.Errorf("%s %v is out of range, must be between %v and %v", name, *v, min, max)
+		}
+		if *v < min {
+			*v = min
+		} else {
+			*v = max
+		}
+		return nil
+	}
+	if err := clamp("temperature", &t.Temperature, 0, 2); err != nil {
+		return t, err
+	}
+	if err := clamp("top_p", &t.TopP, 0, 1); err != nil {
+		return t, err
+	}
+	if err := clamp("presence_penalty", &t.PresencePenalty, -2, 2); err != nil {
+		return t, err
+	}
+	if err := clamp("frequency_penalty", &t.FrequencyPenalty, -2, 2); err != nil {
+		return t, err
+	}
+	if len(t.Stop) > maxStopSequences {
+		return t, fmt.Errorf("%d stop sequences, at most %d are allowed", len(t.Stop), maxStopSequences)
+	}
+	return t, nil
 }
 
 // Chat is a wrapper around the OpenAI API that makes it easier to have a
@@ -66,9 +249,166 @@ type Chat struct {
 	// Tools contains the definitions of any functions that the AI may make
 	// callbacks to. These can easily be created directly from Go functions
 	// using the MakeTool function.
+	//
+	// When the AI requests several tool calls at once, the handlers are
+	// invoked one at a time, in the order the AI listed the calls, and the
+	// results are added to the dialogue in that same order. So given the same
+	// responses from the AI, a conversation is reproducible, which is useful
+	// when snapshot testing.
 	Tools []Tool
 
+	// RateLimiter is used to throttle the requests made by the chat. If nil,
+	// the rate limiter set with SetDefaultRateLimiter is used, if any.
+	RateLimiter *RateLimiter
+
+	// IncludeCurrentTime makes the chat tell the AI the current date and
+	// time, in the Location or UTC if nil, with every request. It's added as
+	// an instruction when sending the request, but is never added to the
+	// dialogue, so it's always up to date.
+	IncludeCurrentTime bool
+	Location           *time.Location
+
+	// DedupToolResults makes tool results that are repeated word for word
+	// later in the dialogue, such as a document fetched again and again by
+	// an agent, be replaced by a short reference to the later copy when
+	// sending the request. This saves tokens in long conversations. Only
+	// results of at least 200 bytes are replaced, and the dialogue itself is
+	// left intact.
+	DedupToolResults bool
+
+	// MaxContextTokens, if set, makes the oldest messages be left out of
+	// requests as needed to keep the prompt, and the room for the response
+	// given by ChatTweaks.MaxTokens, within this many tokens. This lets a
+	// long conversation go on without exceeding the context window of the
+	// model. Messages are only left out of the requests, and are kept in
+	// the dialogue. See Trim for how messages are picked, and for trimming
+	// the dialogue itself.
+	MaxContextTokens int
+
+	// OnNarration is called with the text that the AI sometimes provides
+	// along with a request to call tools, such as "Let me look that up.",
+	// before the tools are invoked. This lets a user interface show what's
+	// going on while waiting for the tools. The text is also kept in the
+	// dialogue, as the content of the message with the tool calls.
+	OnNarration func(content string)
+
+	// OnUnknownTool is called when the AI calls a tool that doesn't exist,
+	// which may happen if the available tools have changed during the
+	// conversation. Its output is passed to the AI as the result of the tool
+	// call. If it returns an error, the AI is not invoked again, and Talk
+	// returns the error.
+	//
+	// If nil, the AI is told that there is no such tool, and gets to try
+	// again. To fail instead, return ErrUnknownTool.
+	OnUnknownTool func(call openai.ToolCall) (output string, err error)
+
+	// ToolErrorFormatter formats an error returned by a tool handler, to be
+	// passed to the AI as the result of the tool call. This can be used to
+	// frame failures consistently, such as prefixing them with "Tool failed:"
+	// or wrapping them in JSON, so that the AI reliably recognizes them.
+	//
+	// If nil, the result is the error message itself.
+	ToolErrorFormatter func(toolName string, err error) string
+
+	// Headers contains extra HTTP headers to send with each request, in
+	// addition to those set with SetDefaultHeaders. This requires a client
+	// created by this package, see NewClient, and fails with
+	// ErrUnsupportedClient otherwise.
+	Headers map[string]string
+
+	// MaxConversationTokens limits the total number of tokens used by the
+	// conversation, as reported by the API. Once exceeded, further requests
+	// fail with ErrBudgetExceeded without calling the API. Zero means no
+	// limit. Note that the request that exceeds the limit is still made, so
+	// the limit can be overshot by the size of one request.
+	MaxConversationTokens int
+
+	// RepairToolArguments enables an attempt to repair malformed JSON in the
+	// arguments the AI passes to tools, before they are handed to the tool
+	// handler. See RepairJSON for details.
+	RepairToolArguments bool
+
+	// RetryEmptyResponses is the number of times to ask the AI again when it
+	// finishes normally without saying anything, which the API is known to
+	// do occasionally. If the response is still empty after that, it's
+	// returned as is. Zero means no retries.
+	RetryEmptyResponses int
+
+	// FailOnTokenLimit makes Talk and Exchange fail with ErrTokenLimit when
+	// the response was cut off for reaching the maximum number of tokens,
+	// see ChatTweaks.MaxTokens, rather than returning the truncated
+	// response. As with any error, Exchange then leaves the dialogue as it
+	// was. Either way, LastFinishReason tells whether the response was cut
+	// off, by returning "length".
+	FailOnTokenLimit bool
+
+	// TrimResponses makes responses have leading and trailing white space,
+	// as well as any control characters other than line breaks and tabs,
+	// removed before they are returned and added to the dialogue. Streamed
+	// responses are only trimmed once complete, not as they are streamed.
+	TrimResponses bool
+
+	// RetryPolicy controls how failed requests to the API are retried, with
+	// exponential backoff. By default, requests aren't retried, and once
+	// enabled, only rate limits and server errors are, unless the policy
+	// says otherwise.
+	RetryPolicy RetryPolicy
+
+	// NoDefaultInstruction disables the DefaultInstruction for this chat.
+	NoDefaultInstruction bool
+
+	// ValidateStreamedOutput enables checking structured output streamed by
+	// ExchangeIntoStream against the schema as it arrives, aborting as soon
+	// as it can't possibly match. See ExchangeIntoStream.
+	ValidateStreamedOutput bool
+
+	// OnDialogueChange is called with the dialogue after each call to Talk
+	// or Exchange, or one of their variants, that changed it, such as by
+	// adding a user message, tool calls and results, and the response. It's
+	// called once the whole turn is done, or has failed, rather than for
+	// each message, which makes it suitable for autosaving or re-rendering a
+	// conversation.
+	OnDialogueChange func(d Dialogue)
+
+	// Recorder, if set, records every request, response and tool call of the
+	// chat, for debugging. See SessionRecorder.
+	Recorder *SessionRecorder
+
+	// Extra contains additional parameters to set in the JSON body of each
+	// request, such as new or experimental ones that this package doesn't
+	// support yet. Parameters set by the Chat itself take precedence, so a
+	// key in Extra is only used if the request doesn't already have it. This
+	// requires a client created by this package, see NewClient.
+	Extra map[string]any
+
+	// Prediction is the expected content of the response, if it's largely
+	// known in advance, such as when making small edits to a document. This
+	// uses OpenAI's predicted outputs, which can reduce latency considerably.
+	// It requires a client created by this package, see NewClient. If empty,
+	// no prediction is sent.
+	Prediction string
+
 	c *openai.Client
+
+	finishReason openai.FinishReason
+	annotations  []Annotation
+	logProbs     *openai.LogProbs
+	toolRounds   int
+	// pending holds tool calls waiting for approval.
+	pending *pendingCalls
+	// fingerprint is the most recent system fingerprint, and
+	// fingerprintChanged tells whether it has changed during the
+	// conversation.
+	fingerprint        string
+	fingerprintChanged bool
+	// usage is the total usage of the conversation.
+	usage openai.Usage
+	// toolChoice is the tool choice for the next request, see ForceTool.
+	toolChoice any
+	// files are the ids of files uploaded by UserSaidWithFiles.
+	files []string
+	// turns holds the usage of each turn of the conversation.
+	turns []Usage
 }
 
 func (c *Chat) client() (client *openai.Client, err error) {
@@ -78,6 +418,35 @@ func (c *Chat) client() (client *openai.Client, err error) {
 	return DefaultClient()
 }
 
+func (c *Chat) rateLimiter() *RateLimiter {
+	if c.RateLimiter != nil {
+		return c.RateLimiter
+	}
+	return defaultRateLimiter
+}
+
+// addDefaultInstruction prepends the DefaultInstruction to the dialogue,
+// unless disabled or the dialogue already starts with an instruction.
+func (c *Chat) addDefaultInstruction() {
+	c.Dialogue = c.withDefaultInstruction(c.Dialogue)
+}
+
+// withDefaultInstruction returns the dialogue with the DefaultInstruction
+// prepended, unless disabled or the dialogue already starts with an
+// instruction. It's only copied if the instruction is added.
+func (c *Chat) withDefaultInstruction(d Dialogue) Dialogue {
+	if DefaultInstruction == "" || c.NoDefaultInstruction {
+		return d
+	}
+	if len(d) > 0 && d[0].Role == openai.ChatMessageRoleSystem {
+		return d
+	}
+	return append(Dialogue{{
+		Role:    openai.ChatMessageRoleSystem,
+		Content: DefaultInstruction,
+	}}, d...)
+}
+
 func (c *Chat) model() string {
 	if c.Model != "" {
 		return c.Model
@@ -85,114 +454,894 @@ func (c *Chat) model() string {
 	return DEFAULT_CHAT_MODEL
 }
 
+// talkOptions holds settings that can be changed for a single call to Talk
+// or Exchange, without changing the Chat.
+type talkOptions struct {
+	// ctx is used for all requests, and checked before invoking tools.
+	ctx   context.Context
+	model string
+	// n is the number of responses to generate, if more than one.
+	n int
+	// toolChoice, if set, is the tool choice of the next request.
+	toolChoice any
+	tools      []Tool
+	// fields are set in the JSON body of the request, for parameters that
+	// go-openai doesn't support.
+	fields map[string]any
+	// extra are set in the JSON body of the request, unless already set.
+	extra map[string]any
+	// onDelta, if set, makes the response be streamed, and is called with
+	// each piece of generated text.
+	onDelta func(delta string)
+	// checkPartial, if set, is called with the content streamed so far, and
+	// aborts the stream if it returns an error.
+	checkPartial func(partial string) error
+	// defaultInstruction makes the DefaultInstruction be added to the
+	// request, for methods that leave the dialogue unchanged.
+	defaultInstruction bool
+}
+
+func (c *Chat) options() talkOptions {
+	var opts = talkOptions{ctx: context.Background(), model: c.model(), tools: c.Tools, extra: c.Extra}
+	if c.Prediction != "" {
+		opts.setField("prediction", map[string]any{
+			"type":    "content",
+			"content": c.Prediction,
+		})
+	}
+	return opts
+}
+
+func (o *talkOptions) setField(key string, value any) {
+	if o.fields == nil {
+		o.fields = make(map[string]any)
+	}
+	o.fields[key] = value
+}
+
+// request builds the request to send to the API for the dialogue so far.
+func (c *Chat) request(opts *talkOptions, tweaks ChatTweaks) openai.ChatCompletionRequest {
+	var tools []openai.Tool
+	for _, t := range opts.tools {
+		tools = append(tools, t.openaiTool())
+	}
+	var messages = c.Dialogue
+	if opts.defaultInstruction {
+		messages = c.withDefaultInstruction(messages)
+	}
+	for _, m := range messages {
+		if m.Role == ChatMessageRoleNote {
+			messages = withoutNotes(messages)
+			break
+		}
+	}
+	if c.DedupToolResults {
+		messages = withoutRepeatedResults(messages)
+	}
+	if c.MaxContextTokens > 0 {
+		var t = TokenizerFor(opts.model)
+		messages, _ = trimToFit(messages, t, c.MaxContextTokens-countToolTokens(t, tools)-tweaks.MaxTokens)
+	}
+	if c.IncludeCurrentTime {
+		messages = withCurrentTime(messages, c.Location)
+	}
+	return openai.ChatCompletionRequest{
+		Model:            opts.model,
+		Messages:         messages,
+		Temperature:      tweaks.Temperature,
+		TopP:             tweaks.TopP,
+		PresencePenalty:  tweaks.PresencePenalty,
+		FrequencyPenalty: tweaks.FrequencyPenalty,
+		Seed:             tweaks.Seed,
+		LogitBias:        tweaks.LogitBias,
+		LogProbs:         tweaks.LogProbs,
+		MaxTokens:        tweaks.MaxTokens,
+		Stop:             tweaks.Stop,
+		N:                opts.n,
+		ToolChoice:       opts.toolChoice,
+		Tools:            tools,
+	}
+}
+
+// withoutNotes returns a copy of the dialogue without any notes.
+func withoutNotes(d Dialogue) Dialogue {
+	var res = make(Dialogue, 0, len(d))
+	for _, m := range d {
+		if m.Role != ChatMessageRoleNote {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// minDedupLength is the length of the shortest tool results replaced by
+// withoutRepeatedResults. Shorter ones are hardly worth it.
+const minDedupLength = 200
+
+// withoutRepeatedResults returns the dialogue with tool results that are
+// repeated later on replaced by a reference to the later copy. It's only
+// copied if anything is replaced.
+func withoutRepeatedResults(d Dialogue) Dialogue {
+	var seen = map[string]bool{}
+	var res = d
+	var copied bool
+	for i := len(d) - 1; i >= 0; i-- {
+		var m = d[i]
+		if m.Role != openai.ChatMessageRoleTool || len(m.Content) < minDedupLength {
+			continue
+		}
+		if !seen[m.Content] {
+			seen[m.Content] = true
+			continue
+		}
+		if !copied {
+			res = append(Dialogue(nil), d...)
+			copied = true
+		}
+		res[i].Content = "[identical to a later result]"
+	}
+	return res
+}
+
+// withCurrentTime returns a copy of the dialogue with an instruction telling
+// the current time added after any leading instructions.
+func withCurrentTime(d Dialogue, loc *time.Location) Dialogue {
+	if loc == nil {
+		loc = time.UTC
+	}
+	var n int
+	for n < len(d) && d[n].Role == openai.ChatMessageRoleSystem {
+		n++
+	}
+	var res = make(Dialogue, 0, len(d)+1)
+	res = append(res, d[:n]...)
+	res = append(res, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleSystem,
+		Content: "The current date and time is " + time.Now().In(loc).Format("Monday, 2 January 2006 15:04 MST") + ".",
+	})
+	return append(res, d[n:]...)
+}
+
 // Talk asks the AI to generate a response to the dialogue so far. It returns
 // the response or an error. The response is automatically added to the
 // dialogue.
 //
 // If the chat has tools available for the AI to invoke, Talk will handle such
 // invocations automatically, making multiple API calls as needed.
+//
+// If the model refuses to respond, an error wrapping ErrRefusal and the
+// reason given by the model is returned. This requires a client created by
+// this package, see NewClient.
 func (c *Chat) Talk() (response string, err error) {
-	var tools = make([]openai.Tool, len(c.Tools))
-	for i, t := range c.Tools {
-		tools[i] = t.openaiTool()
+	return c.TalkContext(context.Background())
+}
+
+// TalkContext is like Talk, but with a context that is used for every
+// request to the API, and checked between tool calls. Cancelling it, for
+// example when the client of a server disconnects, stops the conversation
+// without making any further requests.
+func (c *Chat) TalkContext(ctx context.Context) (response string, err error) {
+	defer c.watchDialogue()()
+	var opts = c.options()
+	opts.ctx = ctx
+	return c.talk(&opts)
+}
+
+func (c *Chat) talk(opts *talkOptions) (response string, err error) {
+	if c.pending != nil {
+		return "", fmt.Errorf("a tool call is awaiting approval, call Resume first")
 	}
+	c.addDefaultInstruction()
+	c.startTurn()
+	return c.converse(opts)
+}
+
+// converse keeps talking to the AI, invoking tools as requested, until it
+// responds.
+func (c *Chat) converse(opts *talkOptions) (response string, err error) {
+	var emptyRetries int
 	for {
-		client, err := c.client()
-		if err != nil {
-			return "", err
-		}
-		resp, err := client.CreateChatCompletion(
-			context.Background(),
-			openai.ChatCompletionRequest{
-				Model:       c.model(),
-				Messages:    c.Dialogue,
-				Temperature: c.Tweaks.Temperature,
-				TopP:        c.Tweaks.TopP,
-				Tools:       tools,
-			},
-		)
+		resp, raw, err := c.complete(opts)
 		if err != nil {
 			return "", err
 		}
-		if len(resp.Choices) == 0 {
-			return "", fmt.Errorf("%w: OpenAI API returned no choices", ErrUnexpectedResponse)
-		}
+		// The tool choice only applies to the first request, so that the AI
+		// can respond once a forced tool has been called.
+		opts.toolChoice = nil
 		switch resp.Choices[0].FinishReason {
 		case openai.FinishReasonFunctionCall:
+			metrics.IncErrors("unexpected_response")
 			return "", fmt.Errorf("%w: deprecated function call returned by API", ErrUnexpectedResponse)
 		case openai.FinishReasonToolCalls:
 			var calls = resp.Choices[0].Message.ToolCalls
 			if len(calls) == 0 {
+				metrics.IncErrors("unexpected_response")
 				return "", fmt.Errorf("%w: no calls provided", ErrUnexpectedResponse)
 			}
+			c.toolRounds++
 			c.Dialogue = append(c.Dialogue, resp.Choices[0].Message)
-			for _, call := range calls {
-				var toolErr error
-				var out string
-				if call.Type != "function" {
-					toolErr = fmt.Errorf("error: unknown tool call type %s", call.Type)
-				} else {
-					var found bool
-					for _, t := range c.Tools {
-						if t.Name == call.Function.Name {
-							out, toolErr = t.Handler(call.Function.Arguments)
-							found = true
-							break
-						}
-					}
-					if !found {
-						toolErr = fmt.Errorf("error: no tool found with name %s", call.Function.Name)
-					}
-				}
-				var content string
-				switch {
-				case toolErr != nil:
-					content = toolErr.Error()
-				default:
-					content = out
-				}
-				c.Dialogue = append(c.Dialogue, openai.ChatCompletionMessage{
-					Role:       openai.ChatMessageRoleTool,
-					Content:    content,
-					ToolCallID: call.ID,
-				})
+			if content := resp.Choices[0].Message.Content; content != "" && c.OnNarration != nil {
+				c.OnNarration(content)
+			}
+			if err := c.runTools(calls, opts); err != nil {
+				return "", err
 			}
 			// Invoke the AI once again, now with the tool outputs added
 			// to the dialogue.
 			continue
 		case openai.FinishReasonContentFilter:
+			metrics.IncErrors("content_filter")
 			return "", ErrContentFilter
 		case openai.FinishReasonNull:
+			metrics.IncErrors("not_finished")
 			return "", ErrNotFinished
+		case openai.FinishReasonLength:
+			if c.FailOnTokenLimit {
+				metrics.IncErrors("token_limit")
+				return "", ErrTokenLimit
+			}
+
+		case openai.FinishReasonStop:
+			if resp.Choices[0].Message.Content == "" && emptyRetries < c.RetryEmptyResponses {
+				emptyRetries++
+				continue
+			}
 
 			// On "stop" or "length", we continue to return the response.
 		}
 
-		response = resp.Choices[0].Message.Content
+		if len(raw.Choices) > 0 {
+			c.annotations = raw.Choices[0].Message.Annotations
+		}
+		var msg = resp.Choices[0].Message
+		if c.TrimResponses {
+			msg.Content = trimResponse(msg.Content)
+		}
 		// Add the response from the AI to the dialogue.
-		c.Dialogue = append(c.Dialogue, resp.Choices[0].Message)
-		return response, nil
+		c.Dialogue = append(c.Dialogue, msg)
+		return msg.Content, nil
+	}
+}
+
+// trimResponse removes surrounding white space and stray control characters
+// from a response, see Chat.TrimResponses.
+func trimResponse(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' && r != '\r' && r != '\t' {
+			return -1
+		}
+		return r
+	}, s)
+	return strings.TrimSpace(s)
+}
+
+// runTools invokes the tools for the calls requested by the AI, and adds
+// the results to the dialogue. If a tool requires approval, it stops and
+// returns ErrApprovalRequired, keeping the remaining calls for Resume.
+func (c *Chat) runTools(calls []openai.ToolCall, opts *talkOptions) error {
+	// Tools are invoked sequentially, in the order listed by the AI. This is
+	// a documented guarantee, see Chat.Tools.
+	for i, call := range calls {
+		// Stop if cancelled while the previous tool was running.
+		if err := opts.ctx.Err(); err != nil {
+			return err
+		}
+		if t := findTool(call.Function.Name, opts.tools); t != nil && t.RequiresApproval {
+			c.pending = &pendingCalls{calls: calls[i:], opts: opts}
+			return fmt.Errorf("%w: %s", ErrApprovalRequired, call.Function.Name)
+		}
+		content, err := c.callTool(opts.ctx, call, opts.tools)
+		if err != nil {
+			return err
+		}
+		c.toolSaid(call.ID, content)
+	}
+	return nil
+}
+
+func (c *Chat) toolSaid(callID, content string) {
+	c.Dialogue = append(c.Dialogue, openai.ChatCompletionMessage{
+		Role:       openai.ChatMessageRoleTool,
+		Content:    content,
+		ToolCallID: callID,
+	})
+}
+
+func findTool(name string, tools []Tool) *Tool {
+	for i := range tools {
+		if tools[i].Name == name {
+			return &tools[i]
+		}
+	}
+	return nil
+}
+
+// pendingCalls are tool calls waiting for the first of them to be approved.
+type pendingCalls struct {
+	calls []openai.ToolCall
+	opts  *talkOptions
+}
+
+// PendingApproval returns the tool call waiting for approval, or nil if
+// there is none. See Tool.RequiresApproval.
+func (c *Chat) PendingApproval() *openai.ToolCall {
+	if c.pending == nil {
+		return nil
+	}
+	return &c.pending.calls[0]
+}
+
+// Resume continues the conversation after a call to a tool requiring
+// approval made Talk or Exchange return ErrApprovalRequired. If approved,
+// the tool is invoked, and otherwise the AI is told that the call was
+// denied. The conversation then goes on as if it had never stopped, and the
+// response of the AI is returned, unless another call requires approval.
+func (c *Chat) Resume(approved bool) (response string, err error) {
+	defer c.watchDialogue()()
+	var p = c.pending
+	if p == nil {
+		return "", fmt.Errorf("no tool call awaiting approval")
+	}
+	c.pending = nil
+	// The context of the call that paused is likely done by now.
+	p.opts.ctx = context.Background()
+	var call = p.calls[0]
+	var content = "error: the user did not approve this call"
+	if approved {
+		if content, err = c.callTool(p.opts.ctx, call, p.opts.tools); err != nil {
+			return "", err
+		}
+	}
+	c.toolSaid(call.ID, content)
+	if err := c.runTools(p.calls[1:], p.opts); err != nil {
+		return "", err
+	}
+	return c.converse(p.opts)
+}
+
+// complete makes one request to the API for the dialogue so far, keeping
+// track of usage and the finish reason. The response is guaranteed to have
+// at least one choice.
+func (c *Chat) complete(opts *talkOptions) (openai.ChatCompletionResponse, rawResponse, error) {
+	var resp openai.ChatCompletionResponse
+	var raw rawResponse
+	if c.MaxConversationTokens > 0 && c.usage.TotalTokens >= c.MaxConversationTokens {
+		return resp, raw, ErrBudgetExceeded
+	}
+	client, err := c.client()
+	if err != nil {
+		return resp, raw, err
+	}
+	tweaks, err := c.Tweaks.check()
+	if err != nil {
+		return resp, raw, err
+	}
+	// A tool choice set by ForceTool applies to the next request, whichever
+	// method makes it.
+	if c.toolChoice != nil {
+		opts.toolChoice, c.toolChoice = c.toolChoice, nil
+	}
+	var req = c.request(opts, tweaks)
+	if caps, ok := CapabilitiesOf(req.Model); ok && !caps.Tools && len(req.Tools) > 0 {
+		return resp, raw, fmt.Errorf("%w: %s", ErrToolsUnsupported, req.Model)
+	}
+	if l := c.rateLimiter(); l != nil {
+		if err := l.Wait(opts.ctx, estimateTokens(req)); err != nil {
+			return resp, raw, err
+		}
+	}
+	var st = requestState{
+		header: c.Headers,
+		fields: opts.fields,
+		extra:  opts.extra,
+		files:  hasFiles(req.Messages),
+		stream: opts.onDelta != nil,
 	}
+	metrics.IncRequests(req.Model)
+	var called, streamed bool
+	var onDelta = opts.onDelta
+	if onDelta != nil {
+		onDelta = func(delta string) {
+			streamed = true
+			opts.onDelta(delta)
+		}
+	}
+	var next = func(req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+		called = true
+		if onDelta != nil {
+			return completeStream(withRequestState(opts.ctx, &st), client, req, onDelta, opts.checkPartial)
+		}
+		return client.CreateChatCompletion(withRequestState(opts.ctx, &st), req)
+	}
+	for retry := 0; ; retry++ {
+		if c.Recorder != nil {
+			c.Recorder.record(SessionEvent{Kind: SessionRequest, Request: &req})
+		}
+		if interceptor != nil {
+			resp, err = interceptor(req, next)
+		} else {
+			resp, err = next(req)
+		}
+		if c.Recorder != nil {
+			var ev = SessionEvent{Kind: SessionResponse, Response: &resp}
+			if err != nil {
+				ev.Response, ev.Error = nil, err.Error()
+			}
+			c.Recorder.record(ev)
+		}
+		if err == nil {
+			break
+		}
+		err = classifyError(err)
+		metrics.IncErrors("api")
+		// A stream that has started can't be taken back, so it's not
+		// retried.
+		if retry >= c.RetryPolicy.MaxRetries || streamed || !c.RetryPolicy.retryable(err) {
+			return resp, raw, err
+		}
+		if serr := sleep(opts.ctx, c.RetryPolicy.delay(retry)); serr != nil {
+			return resp, raw, err
+		}
+		// A retry is a request like any other, as far as rate limits go.
+		if l := c.rateLimiter(); l != nil {
+			if err := l.Wait(opts.ctx, estimateTokens(req)); err != nil {
+				return resp, raw, err
+			}
+		}
+		metrics.IncRequests(req.Model)
+	}
+	metrics.AddTokens(req.Model, resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
+	c.usage.PromptTokens += resp.Usage.PromptTokens
+	c.usage.CompletionTokens += resp.Usage.CompletionTokens
+	c.usage.TotalTokens += resp.Usage.TotalTokens
+	if len(c.turns) > 0 {
+		var turn = &c.turns[len(c.turns)-1]
+		turn.Model = req.Model
+		turn.PromptTokens += resp.Usage.PromptTokens
+		turn.CompletionTokens += resp.Usage.CompletionTokens
+		turn.TotalTokens += resp.Usage.TotalTokens
+	}
+	if fp := resp.SystemFingerprint; fp != "" {
+		if c.fingerprint != "" && c.fingerprint != fp {
+			c.fingerprintChanged = true
+		}
+		c.fingerprint = fp
+	}
+	if (len(opts.fields) > 0 || len(opts.extra) > 0 || len(st.header) > 0 || st.files) && called && !st.seen {
+		return resp, raw, ErrUnsupportedClient
+	}
+	if len(st.body) > 0 {
+		// Failing to parse this is not worse than not having it.
+		_ = json.Unmarshal(st.body, &raw)
+	}
+	if len(raw.Choices) > 0 && raw.Choices[0].Message.Refusal != "" {
+		metrics.IncErrors("refusal")
+		return resp, raw, fmt.Errorf("%w: %s", ErrRefusal, raw.Choices[0].Message.Refusal)
+	}
+	if len(resp.Choices) == 0 {
+		metrics.IncErrors("unexpected_response")
+		return resp, raw, fmt.Errorf("%w: OpenAI API returned no choices", ErrUnexpectedResponse)
+	}
+	c.finishReason = resp.Choices[0].FinishReason
+	c.logProbs = resp.Choices[0].LogProbs
+	return resp, raw, nil
+}
+
+// TalkOnce makes a single request to the API for the dialogue so far, and
+// returns the message generated by the AI along with the reason it finished,
+// without adding anything to the dialogue. Any tool calls requested by the
+// AI are not invoked, but returned as part of the message. This lets you run
+// the loop of invoking tools and talking again yourself.
+//
+// Unlike Talk, a finish reason such as "content_filter" isn't turned into an
+// error, but it's up to the caller to check. Refusals are still reported as
+// errors wrapping ErrRefusal.
+func (c *Chat) TalkOnce() (message openai.ChatCompletionMessage, finishReason openai.FinishReason, err error) {
+	var opts = c.options()
+	opts.defaultInstruction = true
+	c.startTurn()
+	resp, raw, err := c.complete(&opts)
+	if err != nil {
+		return message, "", err
+	}
+	if len(raw.Choices) > 0 {
+		c.annotations = raw.Choices[0].Message.Annotations
+	}
+	return resp.Choices[0].Message, resp.Choices[0].FinishReason, nil
+}
+
+// ForceTool makes the AI call the named tool, one of the tools of the chat,
+// in response to the next call to Talk, Exchange or the like. Once the tool
+// has been called, the AI is free to respond as usual. This is useful when
+// it's known what tool is needed, such as one for extracting data.
+//
+// The name can also be "none", making the AI respond without calling any
+// tool, "required", making it call any of them, or "auto", the default,
+// leaving it to the AI to decide.
+func (c *Chat) ForceTool(name string) error {
+	switch name {
+	case "none", "required", "auto":
+		c.toolChoice = name
+		return nil
+	}
+	if findTool(name, c.Tools) == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownTool, name)
+	}
+	c.toolChoice = openai.ToolChoice{
+		Type:     openai.ToolTypeFunction,
+		Function: openai.ToolFunction{Name: name},
+	}
+	return nil
+}
+
+// TalkN asks the AI to generate n alternative responses to the dialogue so
+// far, and returns them all. Nothing is added to the dialogue, so that the
+// caller can pick one and add it with AssistantSaid. Note that each response
+// counts towards the token usage.
+//
+// As it's not clear how to go on with several responses calling tools, the
+// AI calling tools is reported as an error wrapping ErrUnexpectedResponse.
+func (c *Chat) TalkN(n int) ([]string, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("invalid number of responses: %d", n)
+	}
+	var opts = c.options()
+	opts.n = n
+	opts.defaultInstruction = true
+	c.startTurn()
+	resp, _, err := c.complete(&opts)
+	if err != nil {
+		return nil, err
+	}
+	var responses []string
+	for _, choice := range resp.Choices {
+		switch {
+		case len(choice.Message.ToolCalls) > 0:
+			metrics.IncErrors("unexpected_response")
+			return nil, fmt.Errorf("%w: tool calls when asking for several responses", ErrUnexpectedResponse)
+		case choice.FinishReason == openai.FinishReasonContentFilter:
+			metrics.IncErrors("content_filter")
+			return nil, ErrContentFilter
+		}
+		responses = append(responses, choice.Message.Content)
+	}
+	return responses, nil
+}
+
+// watchDialogue returns a function calling OnDialogueChange if the dialogue
+// has changed since watchDialogue was called. Since the dialogue is only
+// appended to, or rolled back on failure, comparing lengths suffices.
+func (c *Chat) watchDialogue() func() {
+	if c.OnDialogueChange == nil {
+		return func() {}
+	}
+	var n = len(c.Dialogue)
+	return func() {
+		if len(c.Dialogue) != n {
+			c.OnDialogueChange(c.Dialogue)
+		}
+	}
+}
+
+// LastFinishReason returns the reason the AI gave for finishing the most
+// recent response, or an empty string if there is none yet.
+//
+// Note that the API reports "stop" both when the model finished on its own
+// and when it produced one of the stop sequences. The stop sequence itself is
+// not included in the response.
+func (c *Chat) LastFinishReason() openai.FinishReason {
+	return c.finishReason
+}
+
+// LastAnnotations returns the annotations of the most recent response, such
+// as citations of the web pages it's based on. This requires a client
+// created by this package, see NewClient.
+func (c *Chat) LastAnnotations() []Annotation {
+	return c.annotations
+}
+
+// Confidence is a rough measure of how confident the AI was in a response,
+// based on the probabilities of the tokens it generated.
+type Confidence struct {
+	// Average is the average probability of the tokens, between 0 and 1.
+	Average float64
+	// Minimum is the probability of the least likely token, between 0 and 1.
+	// A low minimum with a high average suggests that the response hinged
+	// on a single uncertain choice, such as a name or a number.
+	Minimum float64
+}
+
+// LastConfidence returns the confidence of the most recent response. This
+// requires ChatTweaks.LogProbs to be set, and ok is false if the response
+// has no log probabilities, such as when it only had tool calls. A low
+// confidence can be a reason to escalate to a better model or to a human,
+// but what counts as low depends on the model and task, so calibrate the
+// threshold against responses known to be good and bad.
+func (c *Chat) LastConfidence() (conf Confidence, ok bool) {
+	if c.logProbs == nil || len(c.logProbs.Content) == 0 {
+		return conf, false
+	}
+	conf.Minimum = 1
+	for _, lp := range c.logProbs.Content {
+		var p = math.Exp(lp.LogProb)
+		conf.Average += p
+		if p < conf.Minimum {
+			conf.Minimum = p
+		}
+	}
+	conf.Average /= float64(len(c.logProbs.Content))
+	return conf, true
+}
+
+// ReproducibilityInfo summarizes what affects whether a conversation can be
+// reproduced, see Chat.ReproducibilityInfo.
+type ReproducibilityInfo struct {
+	// Seed is the seed used for sampling, if any, see ChatTweaks.Seed.
+	Seed *int
+	// SystemFingerprint identifies the backend configuration that generated
+	// the most recent response, or is empty if the API didn't report one.
+	SystemFingerprint string
+	// FingerprintChanged is set if different responses in the conversation
+	// were generated by different backend configurations, in which case the
+	// same seed may not give the same results.
+	FingerprintChanged bool
+	// Usage is the total token usage of the conversation.
+	Usage openai.Usage
+}
+
+// ReproducibilityInfo returns a summary of the seed, system fingerprints and
+// usage of the conversation so far, for checking whether it's reproducible.
+// Fingerprints aren't reported for streamed responses.
+func (c *Chat) ReproducibilityInfo() ReproducibilityInfo {
+	return ReproducibilityInfo{
+		Seed:               c.Tweaks.Seed,
+		SystemFingerprint:  c.fingerprint,
+		FingerprintChanged: c.fingerprintChanged,
+		Usage:              c.usage,
+	}
+}
+
+// Usage is the token usage of a turn of the conversation, that is, of a
+// call to Talk, Exchange or the like, summed over all requests it made.
+type Usage struct {
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+}
+
+// startTurn resets the state kept about the most recent turn, and starts
+// counting the usage of a new one.
+func (c *Chat) startTurn() {
+	c.annotations = nil
+	c.toolRounds = 0
+	c.turns = append(c.turns, Usage{})
+}
+
+// UsageByTurn returns the token usage of each turn of the conversation, in
+// order, for finding out which parts of it drive the cost. Turns that
+// failed are included, as they cost all the same. Streamed responses have no
+// reported usage, see TalkStream.
+func (c *Chat) UsageByTurn() []Usage {
+	return append([]Usage(nil), c.turns...)
+}
+
+// SystemFingerprint returns the system fingerprint of the most recent
+// response, identifying the backend configuration that generated it, or an
+// empty string if the API didn't report one. When using a fixed seed, see
+// ChatTweaks.Seed, a change of fingerprint means that the same seed may no
+// longer give the same results, as determinism is only best effort. See
+// ReproducibilityInfo for whether it changed during the conversation.
+func (c *Chat) SystemFingerprint() string {
+	return c.fingerprint
+}
+
+// LastUsage returns the token usage of the most recent turn of the
+// conversation, summed over all requests made in it, such as when the AI
+// called tools, so that it reflects the cost of the whole exchange. Use
+// PriceOf with the model to get the price of it. It's zero if nothing has
+// been said yet.
+func (c *Chat) LastUsage() Usage {
+	if len(c.turns) == 0 {
+		return Usage{}
+	}
+	return c.turns[len(c.turns)-1]
+}
+
+// LastToolRounds returns the number of times the AI asked for tools to be
+// called during the most recent call to Talk or Exchange. The number of
+// requests made to the API is one more than that, unless it failed. A high
+// number may be a sign of a prompt causing needless back-and-forth.
+func (c *Chat) LastToolRounds() int {
+	return c.toolRounds
+}
+
+// callTool invokes the handler of the tool requested by the AI, and returns
+// the content of the tool message to respond with. Errors from the handler
+// are passed on to the AI, so an error is only returned if the AI shouldn't
+// be invoked again.
+func (c *Chat) callTool(ctx context.Context, call openai.ToolCall, tools []Tool) (string, error) {
+	out, err := c.invokeTool(ctx, call, tools)
+	if c.Recorder != nil {
+		var ev = SessionEvent{Kind: SessionToolCall, ToolCall: &call, Result: out}
+		if err != nil {
+			ev.Error = err.Error()
+		}
+		c.Recorder.record(ev)
+	}
+	return out, err
+}
+
+func (c *Chat) invokeTool(ctx context.Context, call openai.ToolCall, tools []Tool) (string, error) {
+	if call.Type != "function" {
+		return fmt.Sprintf("error: unknown tool call type %s", call.Type), nil
+	}
+	var args = call.Function.Arguments
+	if c.RepairToolArguments {
+		args = RepairJSON(args)
+	}
+	metrics.IncToolCalls(call.Function.Name)
+	for _, t := range tools {
+		if t.Name == call.Function.Name {
+			if t.RateLimiter != nil {
+				if err := t.RateLimiter.Wait(ctx, 0); err != nil {
+					return "", err
+				}
+			}
+			out, err := runHandler(ctx, &t, args)
+			if err != nil && ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			if err != nil {
+				metrics.IncErrors("tool")
+				if c.ToolErrorFormatter != nil {
+					return c.ToolErrorFormatter(t.Name, err), nil
+				}
+				return err.Error(), nil
+			}
+			return out, nil
+		}
+	}
+	metrics.IncErrors("unknown_tool")
+	if c.OnUnknownTool != nil {
+		return c.OnUnknownTool(call)
+	}
+	return fmt.Sprintf("error: no tool found with name %s", call.Function.Name), nil
+}
+
+// RerunTools invokes the tools again for every tool call in the dialogue,
+// using the arguments given by the AI at the time, and replaces the recorded
+// results with the new ones. This is useful when resuming a saved
+// conversation, if the world may have changed since the tools were called.
+//
+// Tools are invoked in the order they appear in the dialogue. An error is
+// returned if a tool call lacks a result in the dialogue, in which case no
+// tools are invoked.
+func (c *Chat) RerunTools() error {
+	var results = map[string]int{}
+	for i, m := range c.Dialogue {
+		if m.Role == openai.ChatMessageRoleTool {
+			results[m.ToolCallID] = i
+		}
+	}
+	for _, m := range c.Dialogue {
+		for _, call := range m.ToolCalls {
+			if _, ok := results[call.ID]; !ok {
+				return fmt.Errorf("no result found for tool call %s", call.ID)
+			}
+		}
+	}
+	for _, m := range c.Dialogue {
+		for _, call := range m.ToolCalls {
+			content, err := c.callTool(context.Background(), call, c.Tools)
+			if err != nil {
+				return err
+			}
+			c.Dialogue[results[call.ID]].Content = content
+		}
+	}
+	return nil
 }
 
 // Exchange adds a message from the user to the dialogue and asks the AI to
 // generate a response. If there was an error, the dialogue is not modified.
 func (c *Chat) Exchange(content string) (response string, err error) {
+	return c.ExchangeContext(context.Background(), content)
+}
+
+// ExchangeContext is like Exchange, but with a context, see TalkContext. If
+// the context is cancelled, the dialogue is not modified, even if tools were
+// called before it was.
+func (c *Chat) ExchangeContext(ctx context.Context, content string) (response string, err error) {
+	defer c.watchDialogue()()
+	var opts = c.options()
+	opts.ctx = ctx
+	return c.exchange(content, &opts)
+}
+
+// ExchangeWithTools is like Exchange, but only the given tools are made
+// available to the AI for this exchange, instead of the Tools of the chat.
+// Offering only the tools relevant to a message saves tokens, and makes it
+// easier for the AI to pick the right one.
+func (c *Chat) ExchangeWithTools(content string, tools []Tool) (response string, err error) {
+	defer c.watchDialogue()()
+	var opts = c.options()
+	opts.tools = tools
+	return c.exchange(content, &opts)
+}
+
+// ExchangeWithModel is like Exchange, but uses the given model for this
+// exchange only, for example to escalate a hard question to a more capable
+// model.
+func (c *Chat) ExchangeWithModel(content, model string) (response string, err error) {
+	defer c.watchDialogue()()
+	var opts = c.options()
+	opts.model = model
+	return c.exchange(content, &opts)
+}
+
+func (c *Chat) exchange(content string, opts *talkOptions) (response string, err error) {
 	if content == "" {
 		return "", fmt.Errorf("empty content")
 	}
-	var dlen = len(c.Dialogue)
+	// The default instruction is only kept if the exchange succeeds.
+	var before = c.Dialogue
+	c.addDefaultInstruction()
 	// Add the user's message to the dialogue.
 	c.UserSaid(content)
-	if resp, err := c.Talk(); err != nil {
-		// Reset the dialogue to how it was before the call to Exchange.
-		c.Dialogue = c.Dialogue[:dlen]
+	if resp, err := c.talk(opts); err != nil {
+		// Reset the dialogue to how it was before the call to Exchange,
+		// unless waiting to resume it.
+		if !errors.Is(err, ErrApprovalRequired) || c.pending == nil {
+			c.Dialogue = before
+		}
 		return "", err
 	} else {
 		return resp, nil
 	}
 }
 
+// ExchangeWithPrefix is like Exchange, but the response of the AI is made to
+// start with the given prefix, for example to make it respond in a certain
+// format. The prefix is added as the start of a response from the AI, which
+// it's then asked to continue. The returned response, which is also what's
+// added to the dialogue, includes the prefix.
+//
+// Not all models are trained to continue a response like this, and some will
+// start a new response, possibly repeating the prefix. If the response starts
+// with the prefix, it's not added again.
+//
+// Unlike Exchange, this can't be resumed if the AI calls a tool requiring
+// approval. It fails with ErrApprovalRequired, leaving the dialogue
+// unchanged and nothing awaiting approval.
+func (c *Chat) ExchangeWithPrefix(content, prefix string) (response string, err error) {
+	defer c.watchDialogue()()
+	if content == "" {
+		return "", fmt.Errorf("empty content")
+	}
+	var opts = c.options()
+	var before = c.Dialogue
+	c.addDefaultInstruction()
+	var dlen = len(c.Dialogue)
+	c.UserSaid(content)
+	c.AssistantSaid(prefix)
+	resp, err := c.talk(&opts)
+	if err != nil {
+		// Resume wouldn't know to splice in the prefix, so a pending tool
+		// call is dropped along with the rest of the exchange.
+		c.pending = nil
+		c.Dialogue = before
+		return "", err
+	}
+	if !strings.HasPrefix(resp, prefix) {
+		resp = prefix + resp
+	}
+	// Replace the prefix and the continuation with the full response.
+	c.Dialogue = append(c.Dialogue[:dlen+1], c.Dialogue[dlen+2:]...)
+	c.Dialogue[len(c.Dialogue)-1].Content = resp
+	return resp, nil
+}
+
 // MustExchange is like Exchange, but panics if there was an error. It is not
 // recommended for normal use, but can be convenient for quick hacks when
 // testing things out and running your program manually from command line.
@@ -204,6 +1353,249 @@ func (c *Chat) MustExchange(content string) string {
 	return resp
 }
 
+// Reset clears the dialogue, so that the chat can be reused for a new
+// conversation with the same configuration, such as model, tweaks and tools.
+// If keepInstructions is set, the system messages at the start of the
+// dialogue are kept.
+func (c *Chat) Reset(keepInstructions bool) {
+	var n int
+	if keepInstructions {
+		for n < len(c.Dialogue) && c.Dialogue[n].Role == openai.ChatMessageRoleSystem {
+			n++
+		}
+	}
+	c.Dialogue = c.Dialogue[:n:n]
+	c.finishReason = ""
+	c.annotations = nil
+	c.logProbs = nil
+	c.toolRounds = 0
+	c.pending = nil
+	c.toolChoice = nil
+	c.fingerprint = ""
+	c.fingerprintChanged = false
+	c.usage = openai.Usage{}
+	c.turns = nil
+}
+
+// BiasWords makes the AI more or less likely to use the given words, by
+// setting the LogitBias of their tokens. The bias ranges from -100, which
+// practically bans a word, to 100, which practically forces it. Words are
+// biased both as they are and with a leading space, since that's how they
+// are tokenized in the middle of a sentence. Note that the bias applies to
+// every token of a word, and so affects other words sharing those tokens.
+//
+// This requires an Encoder to be registered for the model of the chat with
+// RegisterTokenizer, as the token ids can't be determined otherwise.
+func (c *Chat) BiasWords(biases map[string]int) error {
+	var model = c.model()
+	enc, ok := TokenizerFor(model).(Encoder)
+	if !ok {
+		return fmt.Errorf("no encoder registered for model %s", model)
+	}
+	var words = make([]string, 0, len(biases))
+	for w, b := range biases {
+		if b < -100 || b > 100 {
+			return fmt.Errorf("bias %d for %q is not between -100 and 100", b, w)
+		}
+		words = append(words, w)
+	}
+	// Apply in order, so that the result is deterministic when words share
+	// tokens.
+	sort.Strings(words)
+	if c.Tweaks.LogitBias == nil {
+		c.Tweaks.LogitBias = map[string]int{}
+	}
+	for _, w := range words {
+		var variants = []string{w}
+		if !strings.HasPrefix(w, " ") {
+			variants = append(variants, " "+w)
+		}
+		for _, v := range variants {
+			for _, id := range enc.Encode(v) {
+				c.Tweaks.LogitBias[strconv.Itoa(id)] = biases[w]
+			}
+		}
+	}
+	return nil
+}
+
+// Archive removes older messages from the dialogue, keeping only the most
+// recent ones that fit within keepTokens tokens, and returns the removed
+// messages so they can be stored elsewhere. This lets a long conversation
+// go on with a rolling window of history.
+//
+// Leading instructions are always kept, and don't count towards keepTokens.
+// A tool call is never separated from its results, so if the window would
+// start in the middle of one, the results are archived along with it. The
+// tokens are counted with the tokenizer for the model of the chat, see
+// RegisterTokenizer.
+func (c *Chat) Archive(keepTokens int) (archived Dialogue, err error) {
+	if keepTokens < 0 {
+		return nil, fmt.Errorf("negative number of tokens to keep: %d", keepTokens)
+	}
+	var n int
+	for n < len(c.Dialogue) && c.Dialogue[n].Role == openai.ChatMessageRoleSystem {
+		n++
+	}
+	var t = TokenizerFor(c.model())
+	var cut, tokens = len(c.Dialogue), 0
+	for cut > n {
+		// The 3 tokens priming the response are not part of any message.
+		var m = countTokens(t, c.Dialogue[cut-1:cut]) - 3
+		if tokens+m > keepTokens {
+			break
+		}
+		tokens += m
+		cut--
+	}
+	for cut < len(c.Dialogue) && c.Dialogue[cut].Role == openai.ChatMessageRoleTool {
+		cut++
+	}
+	archived = append(archived, c.Dialogue[n:cut]...)
+	c.Dialogue = append(c.Dialogue[:n:n], c.Dialogue[cut:]...)
+	return archived, nil
+}
+
+// Trim removes the oldest messages from the dialogue until the prompt of the
+// next request, including the tool definitions and the room for the
+// response given by ChatTweaks.MaxTokens, fits within maxTokens tokens. It
+// returns the number of messages removed.
+//
+// Leading instructions are always kept, as is the most recent message from
+// the user and anything after it, even if that doesn't fit. A tool call is
+// never separated from its results. The tokens are estimated with the
+// tokenizer for the model of the chat, see TokenizerFor. See also Archive,
+// and MaxContextTokens for trimming automatically.
+func (c *Chat) Trim(maxTokens int) (removed int) {
+	var t = TokenizerFor(c.model())
+	var tools []openai.Tool
+	for _, tool := range c.Tools {
+		tools = append(tools, tool.openaiTool())
+	}
+	c.Dialogue, removed = trimToFit(c.Dialogue, t, maxTokens-countToolTokens(t, tools)-c.Tweaks.MaxTokens)
+	return removed
+}
+
+// Clone returns a copy of the chat, with a dialogue of its own, so that the
+// conversation can be continued in different ways without affecting the
+// original. Everything else, such as the tools, is shared, including
+// callbacks such as OnDialogueChange, which are then called for changes to
+// the clone as well.
+func (c *Chat) Clone() *Chat {
+	var cp = *c
+	cp.Dialogue = append(Dialogue(nil), c.Dialogue...)
+	cp.turns = append([]Usage(nil), c.turns...)
+	return &cp
+}
+
+// chatJSON is what's persisted of a Chat as JSON.
+type chatJSON struct {
+	Model    string     `json:"model,omitempty"`
+	Tweaks   ChatTweaks `json:"tweaks"`
+	Dialogue Dialogue   `json:"dialogue"`
+}
+
+// MarshalJSON encodes the dialogue, model and tweaks of the chat as JSON, so
+// that the conversation can be saved and continued later, see UnmarshalJSON.
+// Nothing else is included, notably not the tools, which can't be encoded as
+// they contain functions, nor the client.
+func (c Chat) MarshalJSON() ([]byte, error) {
+	return json.Marshal(chatJSON{Model: c.Model, Tweaks: c.Tweaks, Dialogue: c.Dialogue})
+}
+
+// UnmarshalJSON restores the dialogue, model and tweaks of a chat encoded by
+// MarshalJSON, replacing those of c. Everything else is left as it is, so
+// tools and other settings can be set before or after restoring. Tools must
+// be set again for the conversation to continue if it used any.
+func (c *Chat) UnmarshalJSON(b []byte) error {
+	var v chatJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	c.Model, c.Tweaks, c.Dialogue = v.Model, v.Tweaks, v.Dialogue
+	return nil
+}
+
+// Compare asks two models to respond to the same message, given the dialogue
+// so far, and returns both responses. The models are asked concurrently, on
+// clones of the chat, so the dialogue is left unchanged. This is useful for
+// evaluating models against each other. The usage of both is added to that
+// of the chat, as a turn for each, see UsageByTurn.
+func (c *Chat) Compare(content, modelA, modelB string) (respA, respB string, err error) {
+	var a, b = c.Clone(), c.Clone()
+	// The dialogue of c doesn't change, whatever happens to the clones.
+	a.OnDialogueChange, b.OnDialogueChange = nil, nil
+	// Any tool choice is used by the clones.
+	c.toolChoice = nil
+	var errA, errB error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		respA, errA = a.ExchangeWithModel(content, modelA)
+	}()
+	go func() {
+		defer wg.Done()
+		respB, errB = b.ExchangeWithModel(content, modelB)
+	}()
+	wg.Wait()
+	// What the clones spent is spent by c, with a turn for each model.
+	var usage, turns = c.usage, len(c.turns)
+	for _, cl := range []*Chat{a, b} {
+		c.usage.PromptTokens += cl.usage.PromptTokens - usage.PromptTokens
+		c.usage.CompletionTokens += cl.usage.CompletionTokens - usage.CompletionTokens
+		c.usage.TotalTokens += cl.usage.TotalTokens - usage.TotalTokens
+		c.turns = append(c.turns, cl.turns[turns:]...)
+	}
+	if errA != nil {
+		return respA, respB, fmt.Errorf("%s: %w", modelA, errA)
+	}
+	if errB != nil {
+		return respA, respB, fmt.Errorf("%s: %w", modelB, errB)
+	}
+	return respA, respB, nil
+}
+
+// Append adds the dialogue of another chat to the end of this one, for
+// example to combine conversations held by sub-agents. Tool call ids that are
+// already used in this dialogue are renamed in the appended messages, to keep
+// the combined dialogue valid.
+func (c *Chat) Append(other Chat) {
+	var used = map[string]bool{}
+	for _, m := range c.Dialogue {
+		for _, call := range m.ToolCalls {
+			used[call.ID] = true
+		}
+	}
+	var renamed = map[string]string{}
+	var rename = func(id string) string {
+		if r, ok := renamed[id]; ok {
+			return r
+		}
+		var r = id
+		for n := 2; used[r]; n++ {
+			r = fmt.Sprintf("%s_%d", id, n)
+		}
+		used[r] = true
+		renamed[id] = r
+		return r
+	}
+	for _, m := range other.Dialogue {
+		if len(m.ToolCalls) > 0 {
+			var calls = make([]openai.ToolCall, len(m.ToolCalls))
+			for i, call := range m.ToolCalls {
+				call.ID = rename(call.ID)
+				calls[i] = call
+			}
+			m.ToolCalls = calls
+		}
+		if m.ToolCallID != "" {
+			m.ToolCallID = rename(m.ToolCallID)
+		}
+		c.Dialogue = append(c.Dialogue, m)
+	}
+}
+
 // AssistantSaid adds a message to the dialogue as if said by the AI.
 func (c *Chat) AssistantSaid(msg string) {
 	c.Dialogue = append(c.Dialogue, openai.ChatCompletionMessage{
@@ -220,6 +1612,16 @@ func (c *Chat) UserSaid(msg string) {
 	})
 }
 
+// Note adds a note to the dialogue, which is never sent to the AI. It can be
+// used to annotate the conversation for your own purposes, such as keeping
+// track of internal state, without affecting the prompt.
+func (c *Chat) Note(txt string) {
+	c.Dialogue = append(c.Dialogue, openai.ChatCompletionMessage{
+		Role:    ChatMessageRoleNote,
+		Content: txt,
+	})
+}
+
 // ExampleExchange is a convenience function that adds a message from the user
 // and a response from the AI to the dialogue. It can be used to guide the AI
 // to respond in a certain way.
@@ -0,0 +1,1172 @@
+package gptease_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Volumental/gptease"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// fakeAPI serves the given chat completion responses in order, and records
+// the requests it receives.
+type fakeAPI struct {
+	mu        sync.Mutex
+	responses []string
+	requests  []map[string]any
+}
+
+func newFakeAPI(t *testing.T, responses ...string) *fakeAPI {
+	var api = &fakeAPI{responses: responses}
+	var srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api.mu.Lock()
+		defer api.mu.Unlock()
+		body, _ := io.ReadAll(r.Body)
+		var req map[string]any
+		_ = json.Unmarshal(body, &req)
+		api.requests = append(api.requests, req)
+		if len(api.responses) == 0 {
+			http.Error(w, `{"error": {"message": "no more responses"}}`, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, api.responses[0])
+		api.responses = api.responses[1:]
+	}))
+	t.Cleanup(srv.Close)
+	var config = openai.DefaultConfig("test")
+	config.BaseURL = srv.URL + "/v1"
+	gptease.SetDefaultClient(gptease.NewClientWithConfig(config))
+	return api
+}
+
+func TestRefusal(t *testing.T) {
+	newFakeAPI(t, `{
+		"choices": [{
+			"message": {"role": "assistant", "content": null, "refusal": "I can't help with that."},
+			"finish_reason": "stop"
+		}]
+	}`)
+	var chat gptease.Chat
+	_, err := chat.Exchange("How do I pick a lock?")
+	if !errors.Is(err, gptease.ErrRefusal) {
+		t.Fatalf("Exchange() error = %v, want %v", err, gptease.ErrRefusal)
+	}
+	if len(chat.Dialogue) != 0 {
+		t.Errorf("len(Dialogue) = %d, want 0", len(chat.Dialogue))
+	}
+}
+
+func TestRerunTools(t *testing.T) {
+	var price = 10
+	var chat = gptease.Chat{
+		Tools: []gptease.Tool{
+			gptease.MakeTool(func(struct{}) (int, error) { return price, nil }, "price", "Current price."),
+		},
+		Dialogue: gptease.Dialogue{
+			{Role: openai.ChatMessageRoleUser, Content: "What's the price?"},
+			{Role: openai.ChatMessageRoleAssistant, ToolCalls: []openai.ToolCall{
+				{ID: "call_1", Type: "function", Function: openai.FunctionCall{Name: "price", Arguments: "{}"}},
+			}},
+			{Role: openai.ChatMessageRoleTool, Content: "5", ToolCallID: "call_1"},
+			{Role: openai.ChatMessageRoleAssistant, Content: "It's 5."},
+		},
+	}
+	if err := chat.RerunTools(); err != nil {
+		t.Fatalf("RerunTools() = %v", err)
+	}
+	if got := chat.Dialogue[2].Content; got != "10" {
+		t.Errorf("tool result = %q, want %q", got, "10")
+	}
+
+	chat.Dialogue = chat.Dialogue[:2]
+	if err := chat.RerunTools(); err == nil {
+		t.Errorf("RerunTools() with missing result = nil, want error")
+	}
+}
+
+func TestReset(t *testing.T) {
+	var chat gptease.Chat
+	chat.Instruction("Talk like a pirate.")
+	chat.ExampleExchange("Hello", "Ahoy!")
+
+	chat.Reset(true)
+	if len(chat.Dialogue) != 1 || chat.Dialogue[0].Role != openai.ChatMessageRoleSystem {
+		t.Errorf("Reset(true) left %v, want only the instruction", chat.Dialogue)
+	}
+	chat.Reset(false)
+	if len(chat.Dialogue) != 0 {
+		t.Errorf("Reset(false) left %v, want nothing", chat.Dialogue)
+	}
+}
+
+func TestDefaultInstruction(t *testing.T) {
+	const hi = `{"choices": [{"message": {"role": "assistant", "content": "Hi"}, "finish_reason": "stop"}]}`
+	newFakeAPI(t, hi, hi, hi)
+	gptease.DefaultInstruction = "Be brief."
+	t.Cleanup(func() { gptease.DefaultInstruction = "" })
+
+	var chat gptease.Chat
+	if _, err := chat.Exchange("Hello"); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if got := contents(chat.Dialogue); len(got) != 3 || got[0] != "Be brief." {
+		t.Errorf("Dialogue = %q, want the default instruction first", got)
+	}
+
+	chat = gptease.Chat{}
+	chat.Instruction("Talk like a pirate.")
+	if _, err := chat.Exchange("Hello"); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if got := contents(chat.Dialogue); len(got) != 3 || got[0] != "Talk like a pirate." {
+		t.Errorf("Dialogue = %q, want only the chat's instruction", got)
+	}
+
+	chat = gptease.Chat{NoDefaultInstruction: true}
+	if _, err := chat.Exchange("Hello"); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if got := contents(chat.Dialogue); len(got) != 2 || got[0] != "Hello" {
+		t.Errorf("Dialogue = %q, want no instruction", got)
+	}
+
+	// The fake API has no more responses, so these fail, and the dialogue
+	// is left as it was, without the default instruction.
+	var changes int
+	chat = gptease.Chat{OnDialogueChange: func(gptease.Dialogue) { changes++ }}
+	if _, err := chat.Exchange("Hello"); err == nil {
+		t.Fatalf("Exchange() error = nil, want error")
+	}
+	if _, err := chat.ExchangeWithPrefix("Hello", "Ahoy"); err == nil {
+		t.Fatalf("ExchangeWithPrefix() error = nil, want error")
+	}
+	if len(chat.Dialogue) != 0 || changes != 0 {
+		t.Errorf("Dialogue = %q, OnDialogueChange called %d times, want nothing", contents(chat.Dialogue), changes)
+	}
+}
+
+func TestIncludeCurrentTime(t *testing.T) {
+	var api = newFakeAPI(t, `{"choices": [{"message": {"role": "assistant", "content": "Noon."}, "finish_reason": "stop"}]}`)
+	var chat = gptease.Chat{IncludeCurrentTime: true, Location: time.FixedZone("CET", 3600)}
+	chat.Instruction("Be brief.")
+	chat.Instruction("Talk like a pirate.")
+	if _, err := chat.Exchange("What time is it?"); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	var msgs = api.requests[0]["messages"].([]any)
+	if len(msgs) != 4 {
+		t.Fatalf("messages sent = %v, want 4", msgs)
+	}
+	var now = msgs[2].(map[string]any)
+	if content, _ := now["content"].(string); now["role"] != "system" || !strings.Contains(content, "CET") {
+		t.Errorf("third message sent = %v, want the time after the instructions", now)
+	}
+	for _, m := range chat.Dialogue {
+		if strings.Contains(m.Content, "current date and time") {
+			t.Errorf("Dialogue has the time: %q", contents(chat.Dialogue))
+		}
+	}
+}
+
+func TestOnNarration(t *testing.T) {
+	newFakeAPI(t,
+		`{"choices": [{"message": {"role": "assistant", "content": "Let me check the time.", "tool_calls": [
+			{"id": "call_1", "type": "function", "function": {"name": "time", "arguments": "{}"}}
+		]}, "finish_reason": "tool_calls"}]}`,
+		`{"choices": [{"message": {"role": "assistant", "content": "Noon."}, "finish_reason": "stop"}]}`,
+	)
+	var narration []string
+	var chat = gptease.Chat{
+		Tools: []gptease.Tool{{
+			Name:       "time",
+			Parameters: `{"type": "object"}`,
+			Handler:    func(string) (string, error) { return "12:00", nil },
+		}},
+		OnNarration: func(content string) { narration = append(narration, content) },
+	}
+	if resp, err := chat.Exchange("What time is it?"); err != nil || resp != "Noon." {
+		t.Fatalf("Exchange() = %q, %v", resp, err)
+	}
+	if len(narration) != 1 || narration[0] != "Let me check the time." {
+		t.Errorf("OnNarration called with %q, want the content of the tool call", narration)
+	}
+}
+
+func TestIsToolCall(t *testing.T) {
+	var call = openai.ToolCall{ID: "call_1", Type: "function", Function: openai.FunctionCall{Name: "time", Arguments: "{}"}}
+	for _, tt := range []struct {
+		name string
+		msg  openai.ChatCompletionMessage
+		want []openai.ToolCall
+	}{
+		{"plain", openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: "Hi"}, nil},
+		{"tool call", openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, ToolCalls: []openai.ToolCall{call}}, []openai.ToolCall{call}},
+		{"empty", openai.ChatCompletionMessage{}, nil},
+	} {
+		if got := gptease.IsToolCall(tt.msg); got != (tt.want != nil) {
+			t.Errorf("IsToolCall(%s) = %v, want %v", tt.name, got, tt.want != nil)
+		}
+		if got := gptease.ToolCallsOf(tt.msg); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ToolCallsOf(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	var got http.Header
+	var srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		_, _ = io.WriteString(w, `{"choices": [{"message": {"role": "assistant", "content": "Hi"}, "finish_reason": "stop"}]}`)
+	}))
+	defer srv.Close()
+	var config = openai.DefaultConfig("test")
+	config.BaseURL = srv.URL + "/v1"
+	gptease.SetDefaultClient(gptease.NewClientWithConfig(config))
+	gptease.SetDefaultHeaders(map[string]string{"OpenAI-Beta": "assistants=v1", "X-Shared": "default"})
+	defer gptease.SetDefaultHeaders(nil)
+
+	var chat = gptease.Chat{Headers: map[string]string{"X-Shared": "chat"}}
+	if _, err := chat.Exchange("Hello"); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if v := got.Get("OpenAI-Beta"); v != "assistants=v1" {
+		t.Errorf("OpenAI-Beta header = %q, want %q", v, "assistants=v1")
+	}
+	if v := got.Get("X-Shared"); v != "chat" {
+		t.Errorf("X-Shared header = %q, want %q", v, "chat")
+	}
+
+	// Other clients can't send the headers.
+	gptease.SetDefaultClient(openai.NewClientWithConfig(config))
+	chat = gptease.Chat{Headers: map[string]string{"X-Shared": "chat"}}
+	if _, err := chat.Exchange("Hello"); !errors.Is(err, gptease.ErrUnsupportedClient) {
+		t.Errorf("Exchange() with other client error = %v, want %v", err, gptease.ErrUnsupportedClient)
+	}
+}
+
+func TestUnknownTool(t *testing.T) {
+	const toolCall = `{
+		"choices": [{
+			"message": {"role": "assistant", "tool_calls": [
+				{"id": "call_1", "type": "function", "function": {"name": "missing", "arguments": "{}"}}
+			]},
+			"finish_reason": "tool_calls"
+		}]
+	}`
+	const answer = `{"choices": [{"message": {"role": "assistant", "content": "Done"}, "finish_reason": "stop"}]}`
+
+	// By default, the AI is told about the problem.
+	var api = newFakeAPI(t, toolCall, answer)
+	var chat gptease.Chat
+	if _, err := chat.Exchange("Go"); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if got := chat.Dialogue[2].Content; got != "error: no tool found with name missing" {
+		t.Errorf("tool result = %q", got)
+	}
+	if len(api.requests) != 2 {
+		t.Errorf("made %d requests, want 2", len(api.requests))
+	}
+
+	// A custom handler can provide a fallback result.
+	newFakeAPI(t, toolCall, answer)
+	chat = gptease.Chat{OnUnknownTool: func(call openai.ToolCall) (string, error) {
+		return "fallback", nil
+	}}
+	if _, err := chat.Exchange("Go"); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if got := chat.Dialogue[2].Content; got != "fallback" {
+		t.Errorf("tool result = %q, want %q", got, "fallback")
+	}
+
+	// Or fail.
+	newFakeAPI(t, toolCall, answer)
+	chat = gptease.Chat{OnUnknownTool: func(call openai.ToolCall) (string, error) {
+		return "", gptease.ErrUnknownTool
+	}}
+	if _, err := chat.Exchange("Go"); !errors.Is(err, gptease.ErrUnknownTool) {
+		t.Fatalf("Exchange() error = %v, want %v", err, gptease.ErrUnknownTool)
+	}
+	if len(chat.Dialogue) != 0 {
+		t.Errorf("len(Dialogue) = %d, want 0", len(chat.Dialogue))
+	}
+}
+
+func TestAppend(t *testing.T) {
+	var subDialogue = func() gptease.Dialogue {
+		return gptease.Dialogue{
+			{Role: openai.ChatMessageRoleAssistant, ToolCalls: []openai.ToolCall{
+				{ID: "call_1", Type: "function", Function: openai.FunctionCall{Name: "f", Arguments: "{}"}},
+				{ID: "call_2", Type: "function", Function: openai.FunctionCall{Name: "f", Arguments: "{}"}},
+			}},
+			{Role: openai.ChatMessageRoleTool, Content: "1", ToolCallID: "call_1"},
+			{Role: openai.ChatMessageRoleTool, Content: "2", ToolCallID: "call_2"},
+		}
+	}
+	var chat = gptease.Chat{Dialogue: subDialogue()}
+	var other = gptease.Chat{Dialogue: subDialogue()}
+	chat.Append(other)
+
+	if len(chat.Dialogue) != 6 {
+		t.Fatalf("len(Dialogue) = %d, want 6", len(chat.Dialogue))
+	}
+	var ids = map[string]bool{}
+	for _, m := range chat.Dialogue {
+		for _, call := range m.ToolCalls {
+			if ids[call.ID] {
+				t.Errorf("duplicate tool call id %s", call.ID)
+			}
+			ids[call.ID] = true
+		}
+	}
+	for _, m := range chat.Dialogue[3:] {
+		if m.ToolCallID != "" && m.ToolCallID != "call_1_2" && m.ToolCallID != "call_2_2" {
+			t.Errorf("tool result for %s, want a renamed id", m.ToolCallID)
+		}
+	}
+	if other.Dialogue[0].ToolCalls[0].ID != "call_1" {
+		t.Errorf("Append modified the other dialogue")
+	}
+}
+
+func TestExchangeWithPrefix(t *testing.T) {
+	for _, content := range []string{` {\"a\": 1}`, `Sure, here's the JSON: {\"a\": 1}`} {
+		var api = newFakeAPI(t, `{"choices": [{"message": {"role": "assistant", "content": "`+content+`"}, "finish_reason": "stop"}]}`)
+		var chat gptease.Chat
+		resp, err := chat.ExchangeWithPrefix("Give me JSON", "Sure, here's the JSON:")
+		if err != nil {
+			t.Fatalf("ExchangeWithPrefix() error = %v", err)
+		}
+		if want := `Sure, here's the JSON: {"a": 1}`; resp != want {
+			t.Errorf("ExchangeWithPrefix() = %q, want %q", resp, want)
+		}
+		if got := contents(chat.Dialogue); len(got) != 2 || got[1] != resp {
+			t.Errorf("Dialogue = %q, want the full response last", got)
+		}
+		var msgs = api.requests[0]["messages"].([]any)
+		if last := msgs[len(msgs)-1].(map[string]any); last["role"] != "assistant" {
+			t.Errorf("last message sent = %v, want the prefix", last)
+		}
+	}
+}
+
+func TestExchangeWithPrefixApproval(t *testing.T) {
+	newFakeAPI(t,
+		`{"choices": [{"message": {"role": "assistant", "tool_calls": [
+			{"id": "call_1", "type": "function", "function": {"name": "pay", "arguments": "{}"}}
+		]}, "finish_reason": "tool_calls"}]}`,
+		`{"choices": [{"message": {"role": "assistant", "content": "Hi"}, "finish_reason": "stop"}]}`,
+	)
+	var chat = gptease.Chat{
+		Tools: []gptease.Tool{{
+			Name:             "pay",
+			Parameters:       `{"type": "object"}`,
+			Handler:          func(string) (string, error) { return "ok", nil },
+			RequiresApproval: true,
+		}},
+	}
+	if _, err := chat.ExchangeWithPrefix("Pay the bill", "Done:"); !errors.Is(err, gptease.ErrApprovalRequired) {
+		t.Fatalf("ExchangeWithPrefix() error = %v, want %v", err, gptease.ErrApprovalRequired)
+	}
+	if call := chat.PendingApproval(); call != nil || len(chat.Dialogue) != 0 {
+		t.Fatalf("PendingApproval() = %v, len(Dialogue) = %d, want nil and 0", call, len(chat.Dialogue))
+	}
+	if resp, err := chat.Exchange("Hello"); err != nil || resp != "Hi" {
+		t.Errorf("Exchange() after failed ExchangeWithPrefix() = %q, %v", resp, err)
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	newFakeAPI(t, `{
+		"choices": [{
+			"message": {"role": "assistant", "content": "It's sunny.", "annotations": [
+				{"type": "url_citation", "url_citation": {"start_index": 0, "end_index": 11, "title": "Weather", "url": "https://example.com"}}
+			]},
+			"finish_reason": "stop"
+		}]
+	}`)
+	var chat gptease.Chat
+	if _, err := chat.Exchange("Weather?"); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	var a = chat.LastAnnotations()
+	if len(a) != 1 || a[0].URLCitation == nil || a[0].URLCitation.URL != "https://example.com" {
+		t.Errorf("LastAnnotations() = %+v", a)
+	}
+}
+
+func TestMaxConversationTokens(t *testing.T) {
+	const answer = `{"choices": [{"message": {"role": "assistant", "content": "Hi"}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 60, "completion_tokens": 40, "total_tokens": 100}}`
+	var api = newFakeAPI(t, answer, answer)
+	var chat = gptease.Chat{MaxConversationTokens: 100}
+	if _, err := chat.Exchange("Hello"); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if _, err := chat.Exchange("Hello again"); !errors.Is(err, gptease.ErrBudgetExceeded) {
+		t.Errorf("Exchange() error = %v, want %v", err, gptease.ErrBudgetExceeded)
+	}
+	if len(api.requests) != 1 {
+		t.Errorf("made %d requests, want 1", len(api.requests))
+	}
+}
+
+func TestNote(t *testing.T) {
+	var api = newFakeAPI(t, `{"choices": [{"message": {"role": "assistant", "content": "Hi"}, "finish_reason": "stop"}]}`)
+	var chat gptease.Chat
+	chat.Instruction("Be nice.")
+	chat.Note("The user seems grumpy.")
+	if _, err := chat.Exchange("Hello"); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if len(chat.Dialogue) != 4 {
+		t.Errorf("len(Dialogue) = %d, want 4", len(chat.Dialogue))
+	}
+	for _, m := range api.requests[0]["messages"].([]any) {
+		if m.(map[string]any)["role"] == gptease.ChatMessageRoleNote {
+			t.Errorf("note was sent to the API")
+		}
+	}
+}
+
+func TestToolErrorFormatter(t *testing.T) {
+	newFakeAPI(t, `{
+		"choices": [{
+			"message": {"role": "assistant", "tool_calls": [
+				{"id": "call_1", "type": "function", "function": {"name": "fail", "arguments": "{}"}}
+			]},
+			"finish_reason": "tool_calls"
+		}]
+	}`, `{"choices": [{"message": {"role": "assistant", "content": "Sorry"}, "finish_reason": "stop"}]}`)
+	var chat = gptease.Chat{
+		Tools: []gptease.Tool{{
+			Name:       "fail",
+			Parameters: `{"type": "object"}`,
+			Handler:    func(string) (string, error) { return "", errors.New("out of order") },
+		}},
+		ToolErrorFormatter: func(name string, err error) string {
+			return fmt.Sprintf("Tool %s failed: %v", name, err)
+		},
+	}
+	if _, err := chat.Exchange("Go"); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if got, want := chat.Dialogue[2].Content, "Tool fail failed: out of order"; got != want {
+		t.Errorf("tool result = %q, want %q", got, want)
+	}
+}
+
+func TestToolOrder(t *testing.T) {
+	newFakeAPI(t, `{
+		"choices": [{
+			"message": {"role": "assistant", "tool_calls": [
+				{"id": "call_1", "type": "function", "function": {"name": "say", "arguments": "c"}},
+				{"id": "call_2", "type": "function", "function": {"name": "say", "arguments": "a"}},
+				{"id": "call_3", "type": "function", "function": {"name": "say", "arguments": "b"}}
+			]},
+			"finish_reason": "tool_calls"
+		}]
+	}`, `{"choices": [{"message": {"role": "assistant", "content": "Done"}, "finish_reason": "stop"}]}`)
+	var called []string
+	var chat = gptease.Chat{
+		Tools: []gptease.Tool{{
+			Name:       "say",
+			Parameters: `{"type": "object"}`,
+			Handler: func(input string) (string, error) {
+				called = append(called, input)
+				return input, nil
+			},
+		}},
+	}
+	if _, err := chat.Exchange("Go"); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if got := chat.LastToolRounds(); got != 1 {
+		t.Errorf("LastToolRounds() = %d, want 1", got)
+	}
+	if got, want := strings.Join(called, ""), "cab"; got != want {
+		t.Errorf("handlers called in order %q, want %q", got, want)
+	}
+	for i, m := range chat.Dialogue[2:5] {
+		if want := fmt.Sprintf("call_%d", i+1); m.ToolCallID != want || m.Content != called[i] {
+			t.Errorf("Dialogue[%d] = %s %q, want %s %q", i+2, m.ToolCallID, m.Content, want, called[i])
+		}
+	}
+}
+
+func TestPrediction(t *testing.T) {
+	var api = newFakeAPI(t, `{"choices": [{"message": {"role": "assistant", "content": "Hello, world!"}, "finish_reason": "stop"}]}`)
+	var chat = gptease.Chat{Prediction: "Hello world!"}
+	if _, err := chat.Exchange("Add a comma."); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	var want = map[string]any{"type": "content", "content": "Hello world!"}
+	if got := api.requests[0]["prediction"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("prediction = %v, want %v", got, want)
+	}
+}
+
+func TestReproducibilityInfo(t *testing.T) {
+	var api = newFakeAPI(t,
+		`{"system_fingerprint": "fp_1", "choices": [{"message": {"role": "assistant", "content": "A"}, "finish_reason": "stop"}], "usage": {"total_tokens": 10}}`,
+		`{"system_fingerprint": "fp_1", "choices": [{"message": {"role": "assistant", "content": "B"}, "finish_reason": "stop"}], "usage": {"total_tokens": 20}}`,
+		`{"system_fingerprint": "fp_2", "choices": [{"message": {"role": "assistant", "content": "C"}, "finish_reason": "stop"}], "usage": {"total_tokens": 30}}`,
+	)
+	var seed = 42
+	var chat = gptease.Chat{Tweaks: gptease.ChatTweaks{Seed: &seed}}
+	for i, want := range []bool{false, false, true} {
+		if _, err := chat.Exchange("Next"); err != nil {
+			t.Fatalf("Exchange() error = %v", err)
+		}
+		if got := chat.ReproducibilityInfo().FingerprintChanged; got != want {
+			t.Errorf("after exchange %d, FingerprintChanged = %v, want %v", i+1, got, want)
+		}
+	}
+	var info = chat.ReproducibilityInfo()
+	if info.SystemFingerprint != "fp_2" || *info.Seed != 42 || info.Usage.TotalTokens != 60 {
+		t.Errorf("ReproducibilityInfo() = %+v", info)
+	}
+	if got := chat.SystemFingerprint(); got != "fp_2" {
+		t.Errorf("SystemFingerprint() = %q, want %q", got, "fp_2")
+	}
+	if api.requests[0]["seed"] != 42.0 {
+		t.Errorf("seed = %v, want 42", api.requests[0]["seed"])
+	}
+}
+
+func TestExtra(t *testing.T) {
+	var api = newFakeAPI(t, `{"choices": [{"message": {"role": "assistant", "content": "Hi"}, "finish_reason": "stop"}]}`)
+	var chat = gptease.Chat{
+		Model: "some-model",
+		Extra: map[string]any{"store": true, "model": "other-model"},
+	}
+	if _, err := chat.Exchange("Hello"); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if got := api.requests[0]["store"]; got != true {
+		t.Errorf("store = %v, want true", got)
+	}
+	if got := api.requests[0]["model"]; got != "some-model" {
+		t.Errorf("model = %v, want some-model", got)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	var chat gptease.Chat
+	chat.Instruction("Be brief.")
+	chat.UserSaid("What's the weather?")
+	chat.Dialogue = append(chat.Dialogue, openai.ChatCompletionMessage{
+		Role:      openai.ChatMessageRoleAssistant,
+		ToolCalls: []openai.ToolCall{{ID: "call_1", Type: "function", Function: openai.FunctionCall{Name: "weather", Arguments: "{}"}}},
+	}, openai.ChatCompletionMessage{
+		Role:       openai.ChatMessageRoleTool,
+		Content:    "sunny",
+		ToolCallID: "call_1",
+	})
+	chat.AssistantSaid("It's sunny.")
+	chat.UserSaid("Thanks!")
+
+	// Room for the last three messages would split the tool call from its
+	// result.
+	archived, err := chat.Archive(20)
+	if err != nil {
+		t.Fatalf("Archive() error = %v", err)
+	}
+	if len(archived) != 3 || archived[0].Content != "What's the weather?" || archived[2].Role != openai.ChatMessageRoleTool {
+		t.Errorf("archived = %v", contents(archived))
+	}
+	if got := contents(chat.Dialogue); len(got) != 3 || got[0] != "Be brief." || got[1] != "It's sunny." {
+		t.Errorf("Dialogue = %v", got)
+	}
+
+	if archived, _ := chat.Archive(0); len(archived) != 2 || len(chat.Dialogue) != 1 {
+		t.Errorf("Archive(0) archived %d, kept %d, want 2 and 1", len(archived), len(chat.Dialogue))
+	}
+}
+
+func TestOnDialogueChange(t *testing.T) {
+	newFakeAPI(t,
+		`{"choices": [{"message": {"role": "assistant", "tool_calls": [
+			{"id": "call_1", "type": "function", "function": {"name": "noop", "arguments": "{}"}}
+		]}, "finish_reason": "tool_calls"}]}`,
+		`{"choices": [{"message": {"role": "assistant", "content": "Done"}, "finish_reason": "stop"}]}`,
+	)
+	var changes []int
+	var chat = gptease.Chat{
+		Tools: []gptease.Tool{{
+			Name:       "noop",
+			Parameters: `{"type": "object"}`,
+			Handler:    func(string) (string, error) { return "", nil },
+		}},
+		OnDialogueChange: func(d gptease.Dialogue) { changes = append(changes, len(d)) },
+	}
+	if _, err := chat.Exchange("Go"); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	// A failed exchange leaves the dialogue unchanged.
+	if _, err := chat.Exchange("Again"); err == nil {
+		t.Fatalf("Exchange() error = nil, want error")
+	}
+	if len(changes) != 1 || changes[0] != 4 {
+		t.Errorf("OnDialogueChange called with lengths %v, want [4]", changes)
+	}
+}
+
+func TestTalkOnce(t *testing.T) {
+	var api = newFakeAPI(t, `{"choices": [{"message": {"role": "assistant", "tool_calls": [
+		{"id": "call_1", "type": "function", "function": {"name": "lookup", "arguments": "{}"}}
+	]}, "finish_reason": "tool_calls"}]}`)
+	var called bool
+	var chat = gptease.Chat{
+		Tools: []gptease.Tool{{
+			Name:       "lookup",
+			Parameters: `{"type": "object"}`,
+			Handler:    func(string) (string, error) { called = true; return "", nil },
+		}},
+	}
+	gptease.DefaultInstruction = "Be brief."
+	t.Cleanup(func() { gptease.DefaultInstruction = "" })
+	chat.UserSaid("Look it up")
+	msg, reason, err := chat.TalkOnce()
+	if err != nil {
+		t.Fatalf("TalkOnce() error = %v", err)
+	}
+	if reason != openai.FinishReasonToolCalls || len(msg.ToolCalls) != 1 || msg.ToolCalls[0].ID != "call_1" {
+		t.Errorf("TalkOnce() = %+v, %v", msg, reason)
+	}
+	if called {
+		t.Errorf("tool was invoked")
+	}
+	if len(chat.Dialogue) != 1 {
+		t.Errorf("len(Dialogue) = %d, want 1", len(chat.Dialogue))
+	}
+	if msgs := api.requests[0]["messages"].([]any); len(msgs) != 2 || msgs[0].(map[string]any)["content"] != "Be brief." {
+		t.Errorf("messages sent = %v, want the default instruction first", msgs)
+	}
+}
+
+func TestRetryEmptyResponses(t *testing.T) {
+	const empty = `{"choices": [{"message": {"role": "assistant", "content": ""}, "finish_reason": "stop"}]}`
+	var api = newFakeAPI(t, empty, empty, `{"choices": [{"message": {"role": "assistant", "content": "Hi"}, "finish_reason": "stop"}]}`)
+	var chat = gptease.Chat{RetryEmptyResponses: 2}
+	if resp, err := chat.Exchange("Hello"); err != nil || resp != "Hi" {
+		t.Errorf("Exchange() = %q, %v, want %q", resp, err, "Hi")
+	}
+	if len(api.requests) != 3 || len(chat.Dialogue) != 2 {
+		t.Errorf("made %d requests, len(Dialogue) = %d, want 3 and 2", len(api.requests), len(chat.Dialogue))
+	}
+
+	// Without retries, the empty response is returned.
+	newFakeAPI(t, empty)
+	chat = gptease.Chat{}
+	if resp, err := chat.Exchange("Hello"); err != nil || resp != "" {
+		t.Errorf("Exchange() = %q, %v, want empty", resp, err)
+	}
+}
+
+func TestRequiresApproval(t *testing.T) {
+	newFakeAPI(t,
+		`{"choices": [{"message": {"role": "assistant", "tool_calls": [
+			{"id": "call_1", "type": "function", "function": {"name": "balance", "arguments": "{}"}},
+			{"id": "call_2", "type": "function", "function": {"name": "pay", "arguments": "{\"amount\": 100}"}}
+		]}, "finish_reason": "tool_calls"}]}`,
+		`{"choices": [{"message": {"role": "assistant", "content": "Paid."}, "finish_reason": "stop"}]}`,
+	)
+	var paid bool
+	var chat = gptease.Chat{
+		Tools: []gptease.Tool{{
+			Name:       "balance",
+			Parameters: `{"type": "object"}`,
+			Handler:    func(string) (string, error) { return "1000", nil },
+		}, {
+			Name:             "pay",
+			Parameters:       `{"type": "object"}`,
+			Handler:          func(string) (string, error) { paid = true; return "ok", nil },
+			RequiresApproval: true,
+		}},
+	}
+	if _, err := chat.Exchange("Pay the bill"); !errors.Is(err, gptease.ErrApprovalRequired) {
+		t.Fatalf("Exchange() error = %v, want %v", err, gptease.ErrApprovalRequired)
+	}
+	if call := chat.PendingApproval(); call == nil || call.ID != "call_2" || paid {
+		t.Fatalf("PendingApproval() = %v, paid = %v", call, paid)
+	}
+	if len(chat.Dialogue) != 3 {
+		t.Errorf("len(Dialogue) = %d, want 3", len(chat.Dialogue))
+	}
+	if _, err := chat.Exchange("Hurry up"); err == nil {
+		t.Errorf("Exchange() while awaiting approval error = nil, want error")
+	}
+
+	resp, err := chat.Resume(true)
+	if err != nil {
+		t.Fatalf("Resume() error = %v", err)
+	}
+	if resp != "Paid." || !paid || chat.PendingApproval() != nil {
+		t.Errorf("Resume() = %q, paid = %v", resp, paid)
+	}
+	if got := contents(chat.Dialogue); len(got) != 5 || got[3] != "ok" {
+		t.Errorf("Dialogue = %q", got)
+	}
+}
+
+func TestExchangeWithTools(t *testing.T) {
+	var api = newFakeAPI(t, `{"choices": [{"message": {"role": "assistant", "content": "Sunny."}, "finish_reason": "stop"}]}`)
+	var tool = func(name string) gptease.Tool {
+		return gptease.Tool{
+			Name:       name,
+			Parameters: `{"type": "object"}`,
+			Handler:    func(string) (string, error) { return "", nil },
+		}
+	}
+	var chat = gptease.Chat{Tools: []gptease.Tool{tool("time"), tool("date")}}
+	if _, err := chat.ExchangeWithTools("What's the weather?", []gptease.Tool{tool("weather")}); err != nil {
+		t.Fatalf("ExchangeWithTools() error = %v", err)
+	}
+	var tools, _ = api.requests[0]["tools"].([]any)
+	if len(tools) != 1 || tools[0].(map[string]any)["function"].(map[string]any)["name"] != "weather" {
+		t.Errorf("tools sent = %v, want only weather", tools)
+	}
+	if len(chat.Tools) != 2 || chat.Tools[0].Name != "time" || chat.Tools[1].Name != "date" {
+		t.Errorf("Tools = %v, want them unchanged", chat.Tools)
+	}
+}
+
+func TestExchangeWithModel(t *testing.T) {
+	var api = newFakeAPI(t, `{"choices": [{"message": {"role": "assistant", "content": "42"}, "finish_reason": "stop"}]}`)
+	var chat = gptease.Chat{Model: "small-model"}
+	resp, err := chat.ExchangeWithModel("What's the answer?", "big-model")
+	if err != nil || resp != "42" {
+		t.Fatalf("ExchangeWithModel() = %q, %v", resp, err)
+	}
+	if got := api.requests[0]["model"]; got != "big-model" {
+		t.Errorf("requested model = %v, want big-model", got)
+	}
+	if chat.Model != "small-model" || len(chat.Dialogue) != 2 {
+		t.Errorf("Model = %q, len(Dialogue) = %d, want small-model and 2", chat.Model, len(chat.Dialogue))
+	}
+}
+
+func TestCompare(t *testing.T) {
+	const hi = `{"choices": [{"message": {"role": "assistant", "content": "Hi"}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 10, "completion_tokens": 1, "total_tokens": 11}}`
+	var api = newFakeAPI(t, hi, hi)
+	var changes int
+	var chat = gptease.Chat{OnDialogueChange: func(gptease.Dialogue) { changes++ }}
+	chat.Instruction("Be nice.")
+	respA, respB, err := chat.Compare("Hello", "model-a", "model-b")
+	if err != nil {
+		t.Fatalf("Compare() error = %v", err)
+	}
+	if respA != "Hi" || respB != "Hi" {
+		t.Errorf("Compare() = %q, %q", respA, respB)
+	}
+	if len(chat.Dialogue) != 1 || changes != 0 {
+		t.Errorf("len(Dialogue) = %d, OnDialogueChange called %d times, want 1 and 0", len(chat.Dialogue), changes)
+	}
+	var models = map[any]bool{}
+	for _, r := range api.requests {
+		models[r["model"]] = true
+	}
+	if !models["model-a"] || !models["model-b"] {
+		t.Errorf("requested models %v, want model-a and model-b", models)
+	}
+	if turns := chat.UsageByTurn(); len(turns) != 2 || turns[0].TotalTokens != 11 || turns[1].TotalTokens != 11 {
+		t.Errorf("UsageByTurn() = %+v, want a turn for each model", turns)
+	}
+}
+
+func TestLastConfidence(t *testing.T) {
+	var api = newFakeAPI(t, `{"choices": [{
+		"message": {"role": "assistant", "content": "Paris."},
+		"logprobs": {"content": [
+			{"token": "Paris", "logprob": -0.01},
+			{"token": ".", "logprob": -0.6931471805599453}
+		]},
+		"finish_reason": "stop"
+	}]}`)
+	var chat = gptease.Chat{Tweaks: gptease.ChatTweaks{LogProbs: true}}
+	if _, ok := chat.LastConfidence(); ok {
+		t.Errorf("LastConfidence() ok before any response")
+	}
+	if _, err := chat.Exchange("What's the capital of France?"); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if api.requests[0]["logprobs"] != true {
+		t.Errorf("logprobs = %v, want true", api.requests[0]["logprobs"])
+	}
+	conf, ok := chat.LastConfidence()
+	if !ok {
+		t.Fatalf("LastConfidence() not ok")
+	}
+	if math.Abs(conf.Minimum-0.5) > 1e-9 || math.Abs(conf.Average-(math.Exp(-0.01)+0.5)/2) > 1e-9 {
+		t.Errorf("LastConfidence() = %+v", conf)
+	}
+}
+
+func TestToolsUnsupported(t *testing.T) {
+	var api = newFakeAPI(t)
+	gptease.SetModelCapabilities("toolless", gptease.ModelCapabilities{Tools: false})
+	var chat = gptease.Chat{
+		Model: "toolless",
+		Tools: []gptease.Tool{{
+			Name:       "time",
+			Parameters: `{"type": "object"}`,
+			Handler:    func(string) (string, error) { return "12:00", nil },
+		}},
+	}
+	if _, err := chat.Exchange("What time is it?"); !errors.Is(err, gptease.ErrToolsUnsupported) {
+		t.Errorf("Exchange() error = %v, want %v", err, gptease.ErrToolsUnsupported)
+	}
+	if len(api.requests) != 0 {
+		t.Errorf("made %d requests, want none", len(api.requests))
+	}
+}
+
+func TestExchangeContext(t *testing.T) {
+	var api = newFakeAPI(t,
+		`{"choices": [{"message": {"role": "assistant", "tool_calls": [
+			{"id": "call_1", "type": "function", "function": {"name": "slow", "arguments": "{}"}},
+			{"id": "call_2", "type": "function", "function": {"name": "slow", "arguments": "{}"}}
+		]}, "finish_reason": "tool_calls"}]}`,
+		`{"choices": [{"message": {"role": "assistant", "content": "Done."}, "finish_reason": "stop"}]}`,
+	)
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var calls int
+	var chat = gptease.Chat{
+		Tools: []gptease.Tool{{
+			Name:       "slow",
+			Parameters: `{"type": "object"}`,
+			Handler: func(string) (string, error) {
+				calls++
+				// The client gives up while the tool is running.
+				cancel()
+				return "done", nil
+			},
+		}},
+	}
+	if _, err := chat.ExchangeContext(ctx, "Do it."); !errors.Is(err, context.Canceled) {
+		t.Fatalf("ExchangeContext() error = %v, want %v", err, context.Canceled)
+	}
+	if calls != 1 || len(api.requests) != 1 {
+		t.Errorf("%d tool calls and %d requests, want 1 of each", calls, len(api.requests))
+	}
+	if len(chat.Dialogue) != 0 {
+		t.Errorf("Dialogue = %v, want it rolled back", chat.Dialogue)
+	}
+	if _, err := chat.ExchangeContext(ctx, "Do it."); !errors.Is(err, context.Canceled) {
+		t.Errorf("ExchangeContext() with cancelled context error = %v, want %v", err, context.Canceled)
+	}
+	if len(api.requests) != 1 {
+		t.Errorf("made a request with a cancelled context")
+	}
+}
+
+func TestTweaksOutOfRange(t *testing.T) {
+	var api = newFakeAPI(t, `{"choices": [{"message": {"role": "assistant", "content": "Hi."}, "finish_reason": "stop"}]}`)
+	var chat = gptease.Chat{Tweaks: gptease.ChatTweaks{Temperature: 2.5, TopP: -1}}
+	if _, err := chat.Exchange("Hello"); err == nil || !strings.Contains(err.Error(), "temperature") {
+		t.Errorf("Exchange() error = %v, want temperature out of range", err)
+	}
+	if len(api.requests) != 0 {
+		t.Fatalf("made a request with tweaks out of range")
+	}
+
+	chat.Tweaks.Clamp = true
+	if _, err := chat.Exchange("Hello"); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if got := api.requests[0]["temperature"]; got != 2.0 {
+		t.Errorf("temperature = %v, want 2", got)
+	}
+	chat.Tweaks = gptease.ChatTweaks{FrequencyPenalty: -3}
+	if _, err := chat.Exchange("Hello"); err == nil || !strings.Contains(err.Error(), "frequency_penalty") {
+		t.Errorf("Exchange() error = %v, want frequency_penalty out of range", err)
+	}
+	if len(api.requests) != 1 {
+		t.Errorf("made a request with a penalty out of range")
+	}
+	// A top_p of 0 is the zero value, which is omitted.
+	if got, ok := api.requests[0]["top_p"]; ok {
+		t.Errorf("top_p = %v, want it clamped to 0", got)
+	}
+}
+
+func TestMaxTokens(t *testing.T) {
+	var truncated = `{"choices": [{"message": {"role": "assistant", "content": "Once upon"}, "finish_reason": "length"}]}`
+	var api = newFakeAPI(t, truncated, truncated)
+	var chat = gptease.Chat{Tweaks: gptease.ChatTweaks{MaxTokens: 2}}
+	resp, err := chat.Exchange("Tell me a story.")
+	if err != nil || resp != "Once upon" {
+		t.Fatalf("Exchange() = %q, %v, want the truncated response", resp, err)
+	}
+	if chat.LastFinishReason() != openai.FinishReasonLength {
+		t.Errorf("LastFinishReason() = %q, want %q", chat.LastFinishReason(), openai.FinishReasonLength)
+	}
+	if api.requests[0]["max_tokens"] != 2.0 {
+		t.Errorf("max_tokens = %v, want 2", api.requests[0]["max_tokens"])
+	}
+
+	chat.FailOnTokenLimit = true
+	var dlen = len(chat.Dialogue)
+	if _, err := chat.Exchange("Tell me another."); !errors.Is(err, gptease.ErrTokenLimit) {
+		t.Errorf("Exchange() error = %v, want %v", err, gptease.ErrTokenLimit)
+	}
+	if len(chat.Dialogue) != dlen {
+		t.Errorf("Dialogue changed on error")
+	}
+}
+
+func TestDedupToolResults(t *testing.T) {
+	var api = newFakeAPI(t, `{"choices": [{"message": {"role": "assistant", "content": "Same."}, "finish_reason": "stop"}]}`)
+	var doc = strings.Repeat("lorem ipsum ", 50)
+	var chat = gptease.Chat{DedupToolResults: true}
+	for i, content := range []string{doc, "short", "short", doc} {
+		var id = fmt.Sprint("call_", i)
+		chat.Dialogue = append(chat.Dialogue, openai.ChatCompletionMessage{
+			Role: openai.ChatMessageRoleAssistant,
+			ToolCalls: []openai.ToolCall{{
+				ID: id, Type: "function", Function: openai.FunctionCall{Name: "fetch", Arguments: "{}"},
+			}},
+		}, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleTool, Content: content, ToolCallID: id})
+	}
+	if _, err := chat.Exchange("Did it change?"); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	var got []string
+	for _, m := range api.requests[0]["messages"].([]any) {
+		if m := m.(map[string]any); m["role"] == "tool" {
+			got = append(got, m["content"].(string))
+		}
+	}
+	var want = []string{"[identical to a later result]", "short", "short", doc}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tool results sent = %q, want %q", got, want)
+	}
+	if chat.Dialogue[1].Content != doc {
+		t.Errorf("Dialogue was modified")
+	}
+}
+
+func TestUsageByTurn(t *testing.T) {
+	newFakeAPI(t,
+		`{"choices": [{"message": {"role": "assistant", "content": "Hi."}, "finish_reason": "stop"}],
+			"usage": {"prompt_tokens": 10, "completion_tokens": 2, "total_tokens": 12}}`,
+		`{"choices": [{"message": {"role": "assistant", "tool_calls": [
+			{"id": "call_1", "type": "function", "function": {"name": "time", "arguments": "{}"}}
+		]}, "finish_reason": "tool_calls"}], "usage": {"prompt_tokens": 20, "completion_tokens": 5, "total_tokens": 25}}`,
+		`{"choices": [{"message": {"role": "assistant", "content": "Noon."}, "finish_reason": "stop"}],
+			"usage": {"prompt_tokens": 30, "completion_tokens": 3, "total_tokens": 33}}`,
+	)
+	var chat = gptease.Chat{
+		Tools: []gptease.Tool{{
+			Name:       "time",
+			Parameters: `{"type": "object"}`,
+			Handler:    func(string) (string, error) { return "12:00", nil },
+		}},
+	}
+	if _, err := chat.Exchange("Hello"); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if _, err := chat.ExchangeWithModel("What time is it?", "gpt-4"); err != nil {
+		t.Fatalf("ExchangeWithModel() error = %v", err)
+	}
+	var want = []gptease.Usage{
+		{Model: gptease.DEFAULT_CHAT_MODEL, PromptTokens: 10, CompletionTokens: 2, TotalTokens: 12},
+		{Model: "gpt-4", PromptTokens: 50, CompletionTokens: 8, TotalTokens: 58},
+	}
+	if got := chat.UsageByTurn(); !reflect.DeepEqual(got, want) {
+		t.Errorf("UsageByTurn() = %+v, want %+v", got, want)
+	}
+	if got := chat.LastUsage(); got != want[1] {
+		t.Errorf("LastUsage() = %+v, want %+v", got, want[1])
+	}
+}
+
+func TestChatJSON(t *testing.T) {
+	var api = newFakeAPI(t, `{"choices": [{"message": {"role": "assistant", "content": "Arr, 42."}, "finish_reason": "stop"}]}`)
+	var seed = 7
+	var chat = gptease.Chat{Model: "gpt-4", Tweaks: gptease.ChatTweaks{Temperature: 0.5, Seed: &seed}}
+	chat.Instruction("Talk like a pirate.")
+	chat.ExampleExchange("Hello", "Ahoy!")
+	b, err := json.Marshal(chat)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+
+	var restored gptease.Chat
+	if err := json.Unmarshal(b, &restored); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if restored.Model != chat.Model || restored.Tweaks.Temperature != 0.5 || *restored.Tweaks.Seed != seed ||
+		!reflect.DeepEqual(restored.Dialogue, chat.Dialogue) {
+		t.Fatalf("restored chat = %+v, want %+v", restored, chat)
+	}
+	if _, err := restored.Exchange("What's the answer?"); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if api.requests[0]["model"] != "gpt-4" || len(api.requests[0]["messages"].([]any)) != 4 {
+		t.Errorf("request = %v", api.requests[0])
+	}
+}
+
+func TestStop(t *testing.T) {
+	var api = newFakeAPI(t,
+		`{"choices": [{"message": {"role": "assistant", "content": "Hi."}, "finish_reason": "stop"}]}`,
+		`{"choices": [{"message": {"role": "assistant", "content": "Hi."}, "finish_reason": "stop"}]}`,
+	)
+	var chat gptease.Chat
+	if _, err := chat.Exchange("Hello"); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if _, ok := api.requests[0]["stop"]; ok {
+		t.Errorf("stop = %v, want none", api.requests[0]["stop"])
+	}
+	chat.Tweaks.Stop = []string{"\n\nUser:"}
+	if resp, err := chat.Exchange("Hello"); err != nil || resp != "Hi." {
+		t.Fatalf("Exchange() = %q, %v", resp, err)
+	}
+	if got := api.requests[1]["stop"]; !reflect.DeepEqual(got, []any{"\n\nUser:"}) {
+		t.Errorf("stop = %v, want the stop sequence", got)
+	}
+	chat.Tweaks.Stop = []string{"a", "b", "c", "d", "e"}
+	if _, err := chat.Exchange("Hello"); err == nil {
+		t.Errorf("Exchange() with 5 stop sequences succeeded")
+	}
+}
+
+func TestTrimResponses(t *testing.T) {
+	newFakeAPI(t, `{"choices": [{"message": {"role": "assistant", "content": "\n  Ahoy,\u0000 matey!\n\tYo ho.\u0007 \n"}, "finish_reason": "stop"}]}`)
+	var chat = gptease.Chat{TrimResponses: true}
+	resp, err := chat.Exchange("Hello")
+	if err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if want := "Ahoy, matey!\n\tYo ho."; resp != want || chat.Dialogue[len(chat.Dialogue)-1].Content != want {
+		t.Errorf("Exchange() = %q, want %q", resp, want)
+	}
+}
+
+func TestToolTimeout(t *testing.T) {
+	var api = newFakeAPI(t,
+		`{"choices": [{"message": {"role": "assistant", "tool_calls": [
+			{"id": "call_1", "type": "function", "function": {"name": "job", "arguments": "{}"}}
+		]}, "finish_reason": "tool_calls"}]}`,
+		`{"choices": [{"message": {"role": "assistant", "content": "The job is slow."}, "finish_reason": "stop"}]}`,
+	)
+	var release = make(chan struct{})
+	defer close(release)
+	var chat = gptease.Chat{
+		Tools: []gptease.Tool{{
+			Name:       "job",
+			Parameters: `{"type": "object"}`,
+			Handler: func(string) (string, error) {
+				<-release
+				return "done", nil
+			},
+			Timeout: 10 * time.Millisecond,
+		}},
+	}
+	if _, err := chat.Exchange("Run the job."); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	var messages = api.requests[1]["messages"].([]any)
+	var result = messages[len(messages)-1].(map[string]any)["content"]
+	if result != "tool timed out after 10ms" {
+		t.Errorf("tool result = %q, want a timeout", result)
+	}
+}
+
+func TestTalkN(t *testing.T) {
+	var api = newFakeAPI(t, `{"choices": [
+		{"index": 0, "message": {"role": "assistant", "content": "Ahoy!"}, "finish_reason": "stop"},
+		{"index": 1, "message": {"role": "assistant", "content": "Avast!"}, "finish_reason": "stop"}
+	]}`)
+	gptease.DefaultInstruction = "Be brief."
+	t.Cleanup(func() { gptease.DefaultInstruction = "" })
+	var chat gptease.Chat
+	chat.UserSaid("Greet me like a pirate.")
+	var dlen = len(chat.Dialogue)
+	responses, err := chat.TalkN(2)
+	if err != nil {
+		t.Fatalf("TalkN() error = %v", err)
+	}
+	if !reflect.DeepEqual(responses, []string{"Ahoy!", "Avast!"}) {
+		t.Errorf("TalkN() = %q", responses)
+	}
+	if api.requests[0]["n"] != 2.0 {
+		t.Errorf("n = %v, want 2", api.requests[0]["n"])
+	}
+	if len(chat.Dialogue) != dlen {
+		t.Errorf("Dialogue = %v, want it unchanged", contents(chat.Dialogue))
+	}
+	if msgs := api.requests[0]["messages"].([]any); len(msgs) != 2 || msgs[0].(map[string]any)["content"] != "Be brief." {
+		t.Errorf("messages sent = %v, want the default instruction first", msgs)
+	}
+}
+
+func TestForceTool(t *testing.T) {
+	var api = newFakeAPI(t,
+		`{"choices": [{"message": {"role": "assistant", "tool_calls": [
+			{"id": "call_1", "type": "function", "function": {"name": "time", "arguments": "{}"}}
+		]}, "finish_reason": "tool_calls"}]}`,
+		`{"choices": [{"message": {"role": "assistant", "content": "Noon."}, "finish_reason": "stop"}]}`,
+		`{"choices": [{"message": {"role": "assistant", "content": "Bye."}, "finish_reason": "stop"}]}`,
+	)
+	var chat = gptease.Chat{
+		Tools: []gptease.Tool{{
+			Name:       "time",
+			Parameters: `{"type": "object"}`,
+			Handler:    func(string) (string, error) { return "12:00", nil },
+		}},
+	}
+	if err := chat.ForceTool("date"); !errors.Is(err, gptease.ErrUnknownTool) {
+		t.Errorf("ForceTool(unknown) error = %v, want %v", err, gptease.ErrUnknownTool)
+	}
+	if err := chat.ForceTool("time"); err != nil {
+		t.Fatalf("ForceTool() error = %v", err)
+	}
+	if _, err := chat.Exchange("Hello"); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	var want = map[string]any{"type": "function", "function": map[string]any{"name": "time"}}
+	if got := api.requests[0]["tool_choice"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("first tool_choice = %v, want %v", got, want)
+	}
+	// Once called, and for the next exchange, it's up to the AI again.
+	for _, req := range api.requests[1:] {
+		if got, ok := req["tool_choice"]; ok {
+			t.Errorf("tool_choice = %v, want none", got)
+		}
+	}
+	if _, err := chat.Exchange("Bye"); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if got, ok := api.requests[2]["tool_choice"]; ok {
+		t.Errorf("tool_choice of next exchange = %v, want none", got)
+	}
+
+	// Methods other than Talk and Exchange use it too.
+	api.responses = append(api.responses, `{"choices": [{"message": {"role": "assistant", "content": "Hi."}, "finish_reason": "stop"}]}`)
+	if err := chat.ForceTool("none"); err != nil {
+		t.Fatalf("ForceTool() error = %v", err)
+	}
+	if _, _, err := chat.TalkOnce(); err != nil {
+		t.Fatalf("TalkOnce() error = %v", err)
+	}
+	if got := api.requests[3]["tool_choice"]; got != "none" {
+		t.Errorf("tool_choice of TalkOnce() = %v, want none", got)
+	}
+}
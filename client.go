@@ -1,20 +1,41 @@
 package gptease
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"strings"
 	"sync"
 
 	openai "github.com/sashabaranov/go-openai"
 )
 
+// ErrUnsupportedClient is returned when using a feature that requires a client
+// created by this package, see NewClient.
+var ErrUnsupportedClient = errors.New("client not created by gptease")
+
 var defaultClient *openai.Client
 var defaultClientOnce sync.Once
+var defaultHeaders map[string]string
+
+// SetDefaultHeaders sets extra HTTP headers to send with every request made
+// by clients created by this package, for example to opt in to beta
+// features with the "OpenAI-Beta" header.
+func SetDefaultHeaders(headers map[string]string) {
+	defaultHeaders = headers
+}
 
 // SetDefaultClient sets the default OpenAI API client.
 //
 // You usually don't need to call this function.
 func SetDefaultClient(client *openai.Client) {
+	// Make sure DefaultClient won't replace it with one of its own.
+	defaultClientOnce.Do(func() {})
 	defaultClient = client
 }
 
@@ -26,8 +47,215 @@ func DefaultClient() (client *openai.Client, err error) {
 			err = fmt.Errorf("OPENAI_API_KEY environment variable not set")
 			return
 		} else {
-			defaultClient = openai.NewClient(apikey)
+			defaultClient = NewClient(apikey)
 		}
 	})
 	return defaultClient, err
 }
+
+// Ping checks that the default client can reach the API with a valid API
+// key, by making a cheap request that lists the available models. Call it
+// at startup to fail early and clearly rather than on first use.
+func Ping() error {
+	client, err := DefaultClient()
+	if err != nil {
+		return err
+	}
+	if _, err := client.ListModels(context.Background()); err != nil {
+		return fmt.Errorf("pinging OpenAI API: %w", err)
+	}
+	return nil
+}
+
+// NewClient creates an OpenAI API client using the given API key.
+//
+// Clients created by this package can see parts of the API that go-openai
+// doesn't expose yet, such as refusals. Some features are therefore only
+// available when using a client created by NewClient or NewClientWithConfig.
+func NewClient(apikey string) *openai.Client {
+	return NewClientWithConfig(openai.DefaultConfig(apikey))
+}
+
+// NewClientWithConfig creates an OpenAI API client with a custom
+// configuration, for example to use a different base URL.
+func NewClientWithConfig(config openai.ClientConfig) *openai.Client {
+	return newClient(config, nil)
+}
+
+func newClient(config openai.ClientConfig, keys *keyPool) *openai.Client {
+	var hc = http.Client{}
+	if config.HTTPClient != nil {
+		hc = *config.HTTPClient
+	}
+	var base = hc.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	hc.Transport = &transport{base: base, keys: keys}
+	config.HTTPClient = &hc
+	return openai.NewClientWithConfig(config)
+}
+
+// requestState is attached to the context of a request to let the transport
+// capture the raw response for parts go-openai doesn't parse.
+type requestState struct {
+	// header contains extra HTTP headers to send with the request.
+	header map[string]string
+	// fields are set in the JSON body of the request, replacing any fields
+	// set by go-openai.
+	fields map[string]any
+	// extra are set in the JSON body of the request, unless already set.
+	extra map[string]any
+	// files is set if the messages include files, which must be rewritten,
+	// see rewriteFileParts.
+	files bool
+	// redirect, if set, makes the transport send the request to another
+	// endpoint than go-openai intended.
+	redirect *redirect
+	// stream is set for streamed responses, which must not be buffered. The
+	// body of such responses isn't captured.
+	stream bool
+	// seen is set once the request passed through our transport.
+	seen bool
+	// status and body hold the raw status code and body of the response.
+	status int
+	body   []byte
+}
+
+type redirect struct {
+	method string
+	path   string
+	body   []byte
+}
+
+type requestStateKey struct{}
+
+func withRequestState(ctx context.Context, st *requestState) context.Context {
+	return context.WithValue(ctx, requestStateKey{}, st)
+}
+
+type transport struct {
+	base http.RoundTripper
+	// keys, if set, are the API keys to distribute requests over.
+	keys *keyPool
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.keys != nil {
+		return t.roundTripWithKeys(req)
+	}
+	return t.roundTrip(req)
+}
+
+func (t *transport) roundTrip(req *http.Request) (*http.Response, error) {
+	st, _ := req.Context().Value(requestStateKey{}).(*requestState)
+	if len(defaultHeaders) > 0 || st != nil && len(st.header) > 0 {
+		req = req.Clone(req.Context())
+		for k, v := range defaultHeaders {
+			req.Header.Set(k, v)
+		}
+		if st != nil {
+			for k, v := range st.header {
+				req.Header.Set(k, v)
+			}
+		}
+	}
+	if st == nil {
+		return t.base.RoundTrip(req)
+	}
+	st.seen = true
+	if (len(st.fields) > 0 || len(st.extra) > 0 || st.files) && req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if st.files {
+			if body, err = rewriteFileParts(body); err != nil {
+				return nil, err
+			}
+		}
+		if body, err = setFields(body, st.fields, st.extra); err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+	if r := st.redirect; r != nil {
+		req = req.Clone(req.Context())
+		req.Method = r.method
+		req.URL.Path = strings.TrimSuffix(req.URL.Path, "/models") + r.path
+		req.Body = io.NopCloser(bytes.NewReader(r.body))
+		req.ContentLength = int64(len(r.body))
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	st.status = resp.StatusCode
+	if st.stream {
+		return resp, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	st.body = body
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// setFields sets fields in a JSON object, replacing any existing values, and
+// then sets the extra fields that aren't set already.
+func setFields(body []byte, fields, extra map[string]any) ([]byte, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return nil, err
+	}
+	for k, v := range fields {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		obj[k] = b
+	}
+	for k, v := range extra {
+		if _, ok := obj[k]; ok {
+			continue
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		obj[k] = b
+	}
+	return json.Marshal(obj)
+}
+
+// apiRequest calls an endpoint of the OpenAI API that go-openai doesn't
+// support, using the configuration and credentials of client. This is done
+// by making a request that go-openai does support, which our transport then
+// redirects to the desired endpoint. The path is relative to the base URL.
+func apiRequest(ctx context.Context, client *openai.Client, method, path string, in, out any) error {
+	var r = redirect{method: method, path: path}
+	if in != nil {
+		var err error
+		if r.body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	var st = requestState{redirect: &r}
+	_, err := client.ListModels(withRequestState(ctx, &st))
+	switch {
+	case !st.seen:
+		return ErrUnsupportedClient
+	case st.status < 200 || st.status >= 300:
+		return err
+	}
+	// Any error from go-openai is due to it trying to parse the response as
+	// a list of models, so we ignore it and parse the response ourselves.
+	return json.Unmarshal(st.body, out)
+}
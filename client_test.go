@@ -0,0 +1,18 @@
+package gptease_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/Volumental/gptease"
+)
+
+func TestPing(t *testing.T) {
+	newFlakyAPI(t, http.StatusUnauthorized)
+	if err := gptease.Ping(); err == nil {
+		t.Errorf("Ping() with invalid key succeeded")
+	}
+	if err := gptease.Ping(); err != nil {
+		t.Errorf("Ping() error = %v", err)
+	}
+}
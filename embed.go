@@ -2,6 +2,9 @@ package gptease
 
 import (
 	"context"
+	"fmt"
+	"math"
+	"strings"
 
 	openai "github.com/sashabaranov/go-openai"
 )
@@ -21,6 +24,60 @@ func (e Embedding) Dot(other Embedding) float32 {
 	return sum
 }
 
+// Norm computes the euclidean length of the embedding.
+func (e Embedding) Norm() float32 {
+	return float32(math.Sqrt(float64(e.Dot(e))))
+}
+
+// Cosine computes the cosine similarity of two embeddings, which is between
+// -1 and 1, where 1 means that they point in the same direction.
+func (e Embedding) Cosine(other Embedding) float32 {
+	var n = e.Norm() * other.Norm()
+	if n == 0 {
+		return 0
+	}
+	return e.Dot(other) / n
+}
+
+// Distance computes the euclidean distance between two embeddings.
+func (e Embedding) Distance(other Embedding) float32 {
+	var sum float32
+	for i, x := range e {
+		var d = x - other[i]
+		sum += d * d
+	}
+	return float32(math.Sqrt(float64(sum)))
+}
+
+// Centroid computes the average of a set of embeddings, for example to get a
+// vector representing a topic from a few texts about it. If normalize is set,
+// the result is scaled to unit length, like the embeddings returned by Embed.
+//
+// All embeddings must have the same length. Nil is returned if there are no
+// embeddings.
+func Centroid(embeddings []Embedding, normalize bool) Embedding {
+	if len(embeddings) == 0 {
+		return nil
+	}
+	var c = make(Embedding, len(embeddings[0]))
+	for _, e := range embeddings {
+		if len(e) != len(c) {
+			panic("embeddings of different lengths")
+		}
+		for i, x := range e {
+			c[i] += x
+		}
+	}
+	var scale = 1 / float32(len(embeddings))
+	if n := c.Norm(); normalize && n > 0 {
+		scale = 1 / n
+	}
+	for i := range c {
+		c[i] *= scale
+	}
+	return c
+}
+
 // Embed computes a vector embedding of a text string.
 //
 // Aside from the embedding vector, it returns the number of tokens found in
@@ -32,6 +89,7 @@ func Embed(text string) (v Embedding, tokenCount int, err error) {
 	if err != nil {
 		return nil, 0, err
 	}
+	metrics.IncRequests(string(openai.LargeEmbedding3))
 	resp, err := client.CreateEmbeddings(
 		context.Background(),
 		openai.EmbeddingRequest{
@@ -40,7 +98,120 @@ func Embed(text string) (v Embedding, tokenCount int, err error) {
 		},
 	)
 	if err != nil {
+		metrics.IncErrors("api")
 		return nil, 0, err
 	}
+	metrics.AddTokens(string(openai.LargeEmbedding3), resp.Usage.PromptTokens, 0)
 	return Embedding(resp.Data[0].Embedding), resp.Usage.PromptTokens, nil
 }
+
+// maxEmbeddingInputs is the maximum number of texts in one embedding request.
+const maxEmbeddingInputs = 2048
+
+// EmbedBatch computes vector embeddings of several texts in a single request,
+// which is a lot faster than calling Embed for each of them. The embeddings
+// are returned in the same order as the texts, along with the total number of
+// tokens in them.
+func EmbedBatch(texts []string) (vs []Embedding, tokenCount int, err error) {
+	if len(texts) == 0 {
+		return nil, 0, nil
+	}
+	client, err := DefaultClient()
+	if err != nil {
+		return nil, 0, err
+	}
+	metrics.IncRequests(string(openai.LargeEmbedding3))
+	resp, err := client.CreateEmbeddings(
+		context.Background(),
+		openai.EmbeddingRequest{
+			Model: openai.LargeEmbedding3,
+			Input: texts,
+		},
+	)
+	if err != nil {
+		metrics.IncErrors("api")
+		return nil, 0, err
+	}
+	metrics.AddTokens(string(openai.LargeEmbedding3), resp.Usage.PromptTokens, 0)
+	vs = make([]Embedding, len(texts))
+	for _, d := range resp.Data {
+		if d.Index < 0 || d.Index >= len(vs) {
+			metrics.IncErrors("unexpected_response")
+			return nil, 0, fmt.Errorf("%w: embedding index %d out of range", ErrUnexpectedResponse, d.Index)
+		}
+		vs[d.Index] = Embedding(d.Embedding)
+	}
+	return vs, resp.Usage.PromptTokens, nil
+}
+
+// EmbedPaced computes vector embeddings of a large number of texts, while
+// staying within a tokens-per-minute (TPM) limit. The texts are split into
+// batches of at most tpm tokens, which are embedded with EmbedBatch, waiting
+// between them as needed. The number of tokens is estimated using the
+// tokenizer registered for the embedding model, see RegisterTokenizer.
+//
+// It blocks until all texts are embedded, and returns the embeddings in the
+// same order as the texts, along with the total number of tokens in them. A
+// tpm of zero means no limit, in which case the texts are only split to keep
+// within the maximum number of inputs per request.
+func EmbedPaced(texts []string, tpm int) (vs []Embedding, tokenCount int, err error) {
+	var limiter = NewRateLimiter(0, tpm)
+	var tokenizer = TokenizerFor(string(openai.LargeEmbedding3))
+	vs = make([]Embedding, 0, len(texts))
+	for start := 0; start < len(texts); {
+		var end, tokens = start, 0
+		for end < len(texts) && end-start < maxEmbeddingInputs {
+			var n = tokenizer.Count(texts[end])
+			if end > start && tpm > 0 && tokens+n > tpm {
+				break
+			}
+			tokens += n
+			end++
+		}
+		if err := limiter.Wait(context.Background(), tokens); err != nil {
+			return nil, 0, err
+		}
+		batch, n, err := EmbedBatch(texts[start:end])
+		if err != nil {
+			return nil, 0, err
+		}
+		vs = append(vs, batch...)
+		tokenCount += n
+		start = end
+	}
+	return vs, tokenCount, nil
+}
+
+// DedupTexts removes duplicates from a list of texts, for example to avoid
+// paying for embedding the same text several times. It returns the unique
+// texts, in the order they first appear, and for each of the given texts the
+// position of its copy among the unique ones. The embeddings of the unique
+// texts can be expanded back like this:
+//
+//	unique, pos := DedupTexts(texts, true)
+//	vs, _, err := EmbedBatch(unique)
+//	...
+//	for i := range texts {
+//		embeddings[i] = vs[pos[i]]
+//	}
+//
+// If normalize is set, texts that differ only in case or whitespace are also
+// considered duplicates, and the first of them is kept.
+func DedupTexts(texts []string, normalize bool) (unique []string, pos []int) {
+	var seen = make(map[string]int, len(texts))
+	pos = make([]int, len(texts))
+	for i, t := range texts {
+		var key = t
+		if normalize {
+			key = strings.ToLower(strings.Join(strings.Fields(t), " "))
+		}
+		p, ok := seen[key]
+		if !ok {
+			p = len(unique)
+			seen[key] = p
+			unique = append(unique, t)
+		}
+		pos[i] = p
+	}
+	return unique, pos
+}
@@ -0,0 +1,69 @@
+package gptease_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/Volumental/gptease"
+)
+
+func embeddingNear(a, b gptease.Embedding) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if math.Abs(float64(a[i]-b[i])) > 1e-6 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCentroid(t *testing.T) {
+	var embeddings = []gptease.Embedding{{1, 0}, {0, 1}}
+	if got, want := gptease.Centroid(embeddings, false), (gptease.Embedding{0.5, 0.5}); !embeddingNear(got, want) {
+		t.Errorf("Centroid() = %v, want %v", got, want)
+	}
+	var s = float32(math.Sqrt(0.5))
+	if got, want := gptease.Centroid(embeddings, true), (gptease.Embedding{s, s}); !embeddingNear(got, want) {
+		t.Errorf("Centroid() = %v, want %v", got, want)
+	}
+	if got := gptease.Centroid(nil, true); got != nil {
+		t.Errorf("Centroid(nil) = %v, want nil", got)
+	}
+}
+
+func TestEmbedPaced(t *testing.T) {
+	var api = newFakeAPI(t, `{
+		"data": [
+			{"index": 1, "embedding": [0, 1]},
+			{"index": 0, "embedding": [1, 0]}
+		],
+		"usage": {"prompt_tokens": 4, "total_tokens": 4}
+	}`)
+	vs, n, err := gptease.EmbedPaced([]string{"first text", "second text"}, 0)
+	if err != nil {
+		t.Fatalf("EmbedPaced() error = %v", err)
+	}
+	if len(api.requests) != 1 {
+		t.Errorf("got %d requests, want 1", len(api.requests))
+	}
+	if n != 4 {
+		t.Errorf("tokenCount = %d, want 4", n)
+	}
+	if len(vs) != 2 || !embeddingNear(vs[0], gptease.Embedding{1, 0}) || !embeddingNear(vs[1], gptease.Embedding{0, 1}) {
+		t.Errorf("EmbedPaced() = %v, want [[1 0] [0 1]]", vs)
+	}
+}
+
+func TestDedupTexts(t *testing.T) {
+	var texts = []string{"Hello world", "hello  world", "Goodbye", "Hello world"}
+	unique, pos := gptease.DedupTexts(texts, false)
+	if len(unique) != 3 || pos[0] != 0 || pos[1] != 1 || pos[2] != 2 || pos[3] != 0 {
+		t.Errorf("DedupTexts(false) = %q, %v", unique, pos)
+	}
+	unique, pos = gptease.DedupTexts(texts, true)
+	if len(unique) != 2 || unique[0] != "Hello world" || pos[1] != 0 || pos[2] != 1 || pos[3] != 0 {
+		t.Errorf("DedupTexts(true) = %q, %v", unique, pos)
+	}
+}
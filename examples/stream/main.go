@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Volumental/gptease"
+)
+
+func main() {
+	var chat gptease.Chat
+	chat.Instruction("Talk like a pirate. A cool pirate.")
+	// Print the response as it's generated, rather than all at once.
+	_, err := chat.ExchangeStream("Tell me how to cook scrambled eggs.", func(delta string) {
+		fmt.Print(delta)
+	})
+	fmt.Println()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,174 @@
+package gptease
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// FileInput is a file, such as a PDF document, to include in a message.
+type FileInput struct {
+	// Name is the name of the file, including an extension telling its
+	// type, such as "report.pdf".
+	Name string
+	Data []byte
+}
+
+// MaxInlineFileSize is the size in bytes of the largest file that is sent
+// as part of a message by UserSaidWithFiles. Larger files are uploaded
+// first, and referred to by their file id.
+var MaxInlineFileSize = 1 << 20
+
+// maxFileSize is the size in bytes of the largest file the API accepts as
+// input to a chat.
+const maxFileSize = 32 << 20
+
+// chatMessagePartTypeFile is the type of the parts of messages holding files.
+// go-openai doesn't support them, so the Text of such parts holds the JSON of
+// the file, which our transport moves to where the API expects it.
+const chatMessagePartTypeFile openai.ChatMessagePartType = "file"
+
+// UserSaidWithFiles adds a message from the user to the dialogue, along with
+// files for the AI to read, such as PDF documents. This lets you ask
+// questions about documents without extracting their text yourself, and the
+// AI also gets to see any images in them. It requires a client created by
+// this package, see NewClient, and a model that supports file inputs.
+//
+// Files of up to MaxInlineFileSize bytes are included in the message. Larger
+// files are uploaded to OpenAI, and remain there until deleted with
+// DeleteFiles. Files larger than 32 MB aren't accepted by the API.
+func (c *Chat) UserSaidWithFiles(text string, files []FileInput) error {
+	var parts = []openai.ChatMessagePart{{
+		Type: openai.ChatMessagePartTypeText,
+		Text: text,
+	}}
+	for _, f := range files {
+		if len(f.Data) > maxFileSize {
+			return fmt.Errorf("file %s is %d bytes, more than the limit of %d", f.Name, len(f.Data), maxFileSize)
+		}
+		var ref = map[string]string{}
+		if len(f.Data) <= MaxInlineFileSize {
+			ref["filename"] = f.Name
+			ref["file_data"] = fmt.Sprintf("data:%s;base64,%s", mimeType(f), base64.StdEncoding.EncodeToString(f.Data))
+		} else {
+			client, err := c.client()
+			if err != nil {
+				return err
+			}
+			file, err := client.CreateFileBytes(context.Background(), openai.FileBytesRequest{
+				Name:    f.Name,
+				Bytes:   f.Data,
+				Purpose: "user_data",
+			})
+			if err != nil {
+				return fmt.Errorf("uploading %s: %w", f.Name, err)
+			}
+			c.files = append(c.files, file.ID)
+			ref["file_id"] = file.ID
+		}
+		b, err := json.Marshal(ref)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, openai.ChatMessagePart{
+			Type: chatMessagePartTypeFile,
+			Text: string(b),
+		})
+	}
+	c.Dialogue = append(c.Dialogue, openai.ChatCompletionMessage{
+		Role:         openai.ChatMessageRoleUser,
+		MultiContent: parts,
+	})
+	return nil
+}
+
+// DeleteFiles deletes the files uploaded by UserSaidWithFiles from OpenAI.
+// Call it once the conversation is over, as the AI can no longer read the
+// files after that, even though they are still referred to by the dialogue.
+func (c *Chat) DeleteFiles() error {
+	if len(c.files) == 0 {
+		return nil
+	}
+	client, err := c.client()
+	if err != nil {
+		return err
+	}
+	for len(c.files) > 0 {
+		if err := client.DeleteFile(context.Background(), c.files[0]); err != nil {
+			return fmt.Errorf("deleting file %s: %w", c.files[0], err)
+		}
+		c.files = c.files[1:]
+	}
+	return nil
+}
+
+func mimeType(f FileInput) string {
+	if t := mime.TypeByExtension(filepath.Ext(f.Name)); t != "" {
+		return t
+	}
+	return http.DetectContentType(f.Data)
+}
+
+// hasFiles tells whether any of the messages include files.
+func hasFiles(messages []openai.ChatCompletionMessage) bool {
+	for _, m := range messages {
+		for _, p := range m.MultiContent {
+			if p.Type == chatMessagePartTypeFile {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rewriteFileParts rewrites the parts of messages holding files in the JSON
+// body of a request from how go-openai encodes them to how the API expects
+// them.
+func rewriteFileParts(body []byte) ([]byte, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return nil, err
+	}
+	var messages []map[string]json.RawMessage
+	if err := json.Unmarshal(obj["messages"], &messages); err != nil {
+		return nil, err
+	}
+	for _, m := range messages {
+		var parts []map[string]json.RawMessage
+		if c := bytes.TrimSpace(m["content"]); len(c) == 0 || c[0] != '[' {
+			continue
+		}
+		if err := json.Unmarshal(m["content"], &parts); err != nil {
+			return nil, err
+		}
+		for _, p := range parts {
+			if string(p["type"]) != `"file"` {
+				continue
+			}
+			var text string
+			if err := json.Unmarshal(p["text"], &text); err != nil {
+				return nil, err
+			}
+			p["file"] = json.RawMessage(text)
+			delete(p, "text")
+		}
+		b, err := json.Marshal(parts)
+		if err != nil {
+			return nil, err
+		}
+		m["content"] = b
+	}
+	b, err := json.Marshal(messages)
+	if err != nil {
+		return nil, err
+	}
+	obj["messages"] = b
+	return json.Marshal(obj)
+}
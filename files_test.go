@@ -0,0 +1,57 @@
+package gptease_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/Volumental/gptease"
+)
+
+func TestUserSaidWithFiles(t *testing.T) {
+	var api = newFakeAPI(t,
+		`{"id": "file-1", "object": "file", "purpose": "user_data"}`,
+		`{"choices": [{"message": {"role": "assistant", "content": "Two pages."}, "finish_reason": "stop"}]}`,
+		`{"id": "file-1", "object": "file", "deleted": true}`,
+	)
+	defer func(size int) { gptease.MaxInlineFileSize = size }(gptease.MaxInlineFileSize)
+	gptease.MaxInlineFileSize = 100
+
+	var chat gptease.Chat
+	err := chat.UserSaidWithFiles("How long are these?", []gptease.FileInput{
+		{Name: "small.pdf", Data: []byte("%PDF-1.4 small")},
+		{Name: "large.pdf", Data: bytes.Repeat([]byte("x"), 200)},
+	})
+	if err != nil {
+		t.Fatalf("UserSaidWithFiles() error = %v", err)
+	}
+	if _, err := chat.Talk(); err != nil {
+		t.Fatalf("Talk() error = %v", err)
+	}
+
+	var messages = api.requests[1]["messages"].([]any)
+	var parts = messages[len(messages)-1].(map[string]any)["content"].([]any)
+	if len(parts) != 3 {
+		t.Fatalf("content = %v, want 3 parts", parts)
+	}
+	var inline = parts[1].(map[string]any)
+	var file, _ = inline["file"].(map[string]any)
+	if inline["type"] != "file" || file["filename"] != "small.pdf" ||
+		!strings.HasPrefix(file["file_data"].(string), "data:application/pdf;base64,") {
+		t.Errorf("inlined file part = %v", inline)
+	}
+	if _, ok := inline["text"]; ok {
+		t.Errorf("inlined file part has text: %v", inline)
+	}
+	var uploaded = parts[2].(map[string]any)
+	if file, _ := uploaded["file"].(map[string]any); file["file_id"] != "file-1" {
+		t.Errorf("uploaded file part = %v", uploaded)
+	}
+
+	if err := chat.DeleteFiles(); err != nil {
+		t.Errorf("DeleteFiles() error = %v", err)
+	}
+	if len(api.responses) != 0 {
+		t.Errorf("uploaded file wasn't deleted")
+	}
+}
@@ -0,0 +1,533 @@
+package gptease
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// Index is a collection of embeddings, identified by a document id, that can
+// be searched for the documents most similar to a query. It does a linear
+// scan of all embeddings, which is fast enough for many thousands of them.
+// For larger collections, see NewApproximateIndex.
+//
+// The zero value is an empty index ready to use.
+type Index struct {
+	// Similarity computes how similar two embeddings are, where a higher
+	// value means more similar. It's used by Search and defaults to cosine
+	// similarity if nil. To find the nearest neighbours by euclidean distance
+	// instead, use:
+	//
+	//	func(a, b Embedding) float32 { return -a.Distance(b) }
+	Similarity func(a, b Embedding) float32
+
+	ids   []string
+	vecs  []Embedding
+	metas []Metadata
+	// pos maps document ids to their position in the slices above.
+	pos map[string]int
+	// keywords indexes the texts of the documents, for hybrid search.
+	keywords keywordIndex
+	// ivf is set for approximate indexes.
+	ivf *ivf
+}
+
+// NewApproximateIndex creates an index doing approximate nearest neighbour
+// search, which is much faster than the exact search of a plain Index for
+// large collections, at the cost of sometimes missing a relevant document.
+//
+// It uses an inverted file (IVF) index: the documents are grouped into
+// lists of similar documents using k-means clustering, and a search only
+// scans the probes lists closest to the query. More lists make searches
+// faster, while more probes make them more accurate. A common choice is
+// around the square root of the number of documents for lists, and a few
+// percent of that for probes.
+//
+// Until there are as many documents as lists, searches are exact. The lists
+// are rebuilt each time the number of documents has doubled since they were
+// last built, which makes that call to Add slow. The lists are based on
+// cosine similarity, so the Similarity of the index should be similar to it
+// for the approximation to be good.
+func NewApproximateIndex(lists, probes int) *Index {
+	if lists < 1 {
+		lists = 1
+	}
+	if probes < 1 {
+		probes = 1
+	}
+	return &Index{ivf: &ivf{lists: lists, probes: probes}}
+}
+
+// ivf holds the inverted file of an approximate index.
+type ivf struct {
+	lists, probes int
+	// centroids are the centroids of the lists, members the positions of
+	// the documents in each list, and list the list of each document. They
+	// are nil until built.
+	centroids []Embedding
+	members   [][]int
+	list      []int
+	// builtAt is the number of documents when the lists were last built.
+	builtAt int
+}
+
+// add adds the document at position i to the list it's closest to, or
+// rebuilds the lists if it's time.
+func (f *ivf) add(vecs []Embedding, i int) {
+	if len(vecs) >= f.lists && len(vecs) >= 2*f.builtAt {
+		f.build(vecs)
+		return
+	}
+	if f.centroids != nil {
+		var c = nearest(vecs[i], f.centroids)
+		f.members[c] = append(f.members[c], i)
+		f.list = append(f.list, c)
+	}
+}
+
+// update moves the document at position i to the list it's now closest to,
+// after its embedding has changed.
+func (f *ivf) update(vecs []Embedding, i int) {
+	if f.centroids == nil {
+		return
+	}
+	f.unlist(i)
+	var c = nearest(vecs[i], f.centroids)
+	f.members[c] = append(f.members[c], i)
+	f.list[i] = c
+}
+
+// remove removes the document at position i, which is replaced by the last
+// document, at position last.
+func (f *ivf) remove(i, last int) {
+	if f.centroids == nil {
+		return
+	}
+	f.unlist(i)
+	if i != last {
+		var c = f.list[last]
+		for j, m := range f.members[c] {
+			if m == last {
+				f.members[c][j] = i
+			}
+		}
+		f.list[i] = c
+	}
+	f.list = f.list[:last]
+}
+
+// unlist removes the document at position i from its list.
+func (f *ivf) unlist(i int) {
+	var c = f.list[i]
+	for j, m := range f.members[c] {
+		if m == i {
+			f.members[c] = append(f.members[c][:j], f.members[c][j+1:]...)
+			break
+		}
+	}
+}
+
+func (f *ivf) build(vecs []Embedding) {
+	var assign []int
+	assign, f.centroids = kmeans(vecs, f.lists, rand.New(rand.NewSource(1)))
+	f.members = make([][]int, f.lists)
+	f.list = assign
+	for i, c := range assign {
+		f.members[c] = append(f.members[c], i)
+	}
+	f.builtAt = len(vecs)
+}
+
+// candidates returns the positions of the documents in the lists closest to
+// the query, or nil if the lists aren't built yet.
+func (f *ivf) candidates(query Embedding) []int {
+	if f.centroids == nil {
+		return nil
+	}
+	var order = make([]int, len(f.centroids))
+	var scores = make([]float32, len(f.centroids))
+	for c, v := range f.centroids {
+		order[c] = c
+		scores[c] = query.Cosine(v)
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return scores[order[i]] > scores[order[j]]
+	})
+	if f.probes < len(order) {
+		order = order[:f.probes]
+	}
+	var res []int
+	for _, c := range order {
+		res = append(res, f.members[c]...)
+	}
+	return res
+}
+
+// Metadata holds arbitrary information about a document in an Index, such as
+// its source, tags or date, which can be used to filter searches.
+type Metadata map[string]any
+
+// SearchResult is a document found by searching an Index.
+type SearchResult struct {
+	ID string
+	// Score is the similarity between the document and the query, which is
+	// their cosine similarity unless the Index has a Similarity function.
+	Score float32
+	// Explanation tells why the document was found, to help with tuning
+	// retrieval.
+	Explanation Explanation
+}
+
+// Explanation tells why a document was found by searching an Index.
+type Explanation struct {
+	// Similarity is the similarity between the embeddings of the document
+	// and the query.
+	Similarity float32
+	// KeywordScore is the BM25 score of the document, scaled so the best
+	// match gets 1, and Terms are the terms of the query found in the text
+	// of the document. They are only set by SearchHybrid.
+	KeywordScore float32
+	Terms        []string
+	// Dimensions are the dimensions of the embeddings contributing the most
+	// to their dot product, in order, which hints at which features of the
+	// query the document matched.
+	Dimensions []int
+}
+
+// explainedDimensions is the number of dimensions given in an Explanation.
+const explainedDimensions = 5
+
+// explain makes an explanation of how the document at position i matches a
+// query, except for the keyword score.
+func (x *Index) explain(query Embedding, queryText string, i int, similarity func(a, b Embedding) float32) Explanation {
+	var v = x.vecs[i]
+	var e = Explanation{Similarity: similarity(query, v)}
+	var dims = make([]int, len(v))
+	for d := range dims {
+		dims[d] = d
+	}
+	sort.SliceStable(dims, func(a, b int) bool {
+		return query[dims[a]]*v[dims[a]] > query[dims[b]]*v[dims[b]]
+	})
+	if len(dims) > explainedDimensions {
+		dims = dims[:explainedDimensions]
+	}
+	e.Dimensions = dims
+	if queryText != "" {
+		var seen = map[string]bool{}
+		for _, t := range keywordTerms(queryText) {
+			if x.keywords.terms[i][t] > 0 && !seen[t] {
+				seen[t] = true
+				e.Terms = append(e.Terms, t)
+			}
+		}
+	}
+	return e
+}
+
+// Add adds the embedding of a document to the index. If the index already
+// has a document with the same id, it's replaced.
+func (x *Index) Add(id string, v Embedding) {
+	x.AddWithMetadata(id, v, nil)
+}
+
+// AddWithMetadata adds the embedding of a document to the index, along with
+// metadata that can be used to filter searches, see SearchFiltered. If the
+// index already has a document with the same id, it's replaced.
+func (x *Index) AddWithMetadata(id string, v Embedding, meta Metadata) {
+	x.AddWithText(id, v, "", meta)
+}
+
+// AddWithText is like AddWithMetadata, but also adds the text of the
+// document, which is used for keyword matching by SearchHybrid. The metadata
+// may be nil.
+func (x *Index) AddWithText(id string, v Embedding, text string, meta Metadata) {
+	if i, ok := x.pos[id]; ok {
+		x.vecs[i] = v
+		x.metas[i] = meta
+		x.keywords.set(i, text)
+		if x.ivf != nil {
+			x.ivf.update(x.vecs, i)
+		}
+		return
+	}
+	if x.pos == nil {
+		x.pos = map[string]int{}
+	}
+	x.pos[id] = len(x.ids)
+	x.ids = append(x.ids, id)
+	x.vecs = append(x.vecs, v)
+	x.metas = append(x.metas, meta)
+	x.keywords.add(text)
+	if x.ivf != nil {
+		x.ivf.add(x.vecs, len(x.vecs)-1)
+	}
+}
+
+// Delete removes a document from the index, and reports whether it was
+// there.
+func (x *Index) Delete(id string) bool {
+	i, ok := x.pos[id]
+	if !ok {
+		return false
+	}
+	// Move the last document into the place of the deleted one.
+	var last = len(x.ids) - 1
+	if x.ivf != nil {
+		x.ivf.remove(i, last)
+	}
+	x.keywords.remove(i, last)
+	x.ids[i], x.vecs[i], x.metas[i] = x.ids[last], x.vecs[last], x.metas[last]
+	x.pos[x.ids[i]] = i
+	delete(x.pos, id)
+	x.ids, x.vecs, x.metas = x.ids[:last], x.vecs[:last], x.metas[:last]
+	return true
+}
+
+// Len returns the number of documents in the index.
+func (x *Index) Len() int {
+	return len(x.ids)
+}
+
+// Search returns the k documents most similar to the query, best first. If
+// k isn't positive, there are no results.
+func (x *Index) Search(query Embedding, k int) []SearchResult {
+	return x.SearchFiltered(query, k, nil)
+}
+
+// SearchFiltered is like Search, but only considers documents for which
+// filter returns true, given the metadata they were added with. The metadata
+// is nil for documents added without any. The filter is applied before
+// selecting the top k, so up to k matching documents are returned, unless
+// the index is approximate and few of them are close to the query. A nil
+// filter matches all documents.
+func (x *Index) SearchFiltered(query Embedding, k int, filter func(meta Metadata) bool) []SearchResult {
+	if k <= 0 {
+		return nil
+	}
+	var similarity = x.Similarity
+	if similarity == nil {
+		similarity = Embedding.Cosine
+	}
+	var results []SearchResult
+	var consider = func(i int) {
+		if filter != nil && !filter(x.metas[i]) {
+			return
+		}
+		results = append(results, SearchResult{ID: x.ids[i], Score: similarity(query, x.vecs[i])})
+	}
+	var candidates []int
+	if x.ivf != nil {
+		candidates = x.ivf.candidates(query)
+	}
+	if candidates != nil {
+		for _, i := range candidates {
+			consider(i)
+		}
+	} else {
+		for i := range x.vecs {
+			consider(i)
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	if k < len(results) {
+		results = results[:k]
+	}
+	for i := range results {
+		results[i].Explanation = x.explain(query, "", x.pos[results[i].ID], similarity)
+	}
+	return results
+}
+
+// SearchHybrid is like Search, but combines the similarity of embeddings
+// with keyword matching, which helps when exact terms such as names or codes
+// matter. The keyword score is computed with BM25 between queryText and the
+// texts of the documents, see AddWithText, and scaled so the best match gets
+// 1. The score of each result is weight times its keyword score plus 1 -
+// weight times its similarity to the query.
+//
+// All documents are scored, even in an approximate index.
+func (x *Index) SearchHybrid(query Embedding, queryText string, k int, weight float32) []SearchResult {
+	if k <= 0 {
+		return nil
+	}
+	var similarity = x.Similarity
+	if similarity == nil {
+		similarity = Embedding.Cosine
+	}
+	var keyword = x.keywords.scores(queryText)
+	var best float32
+	for _, s := range keyword {
+		if s > best {
+			best = s
+		}
+	}
+	var results = make([]SearchResult, len(x.ids))
+	var kws = make([]float32, len(x.ids))
+	for i, v := range x.vecs {
+		if best > 0 {
+			kws[i] = keyword[i] / best
+		}
+		results[i] = SearchResult{
+			ID:    x.ids[i],
+			Score: weight*kws[i] + (1-weight)*similarity(query, v),
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	if k < len(results) {
+		results = results[:k]
+	}
+	for i := range results {
+		var p = x.pos[results[i].ID]
+		results[i].Explanation = x.explain(query, queryText, p, similarity)
+		results[i].Explanation.KeywordScore = kws[p]
+	}
+	return results
+}
+
+// SearchMMR is like Search, but reranks the results using maximal marginal
+// relevance (MMR), to avoid returning several documents saying the same
+// thing. Documents are picked one at a time, balancing their similarity to
+// the query against their similarity to the documents already picked. The
+// balance is set by lambda, from 0 for maximal diversity to 1 for maximal
+// relevance, which is the same as Search. A lambda of 0.5 to 0.7 is typical.
+//
+// The candidates are the 4*k documents most similar to the query. The score
+// of each result is its similarity to the query, as with Search, so results
+// are not necessarily ordered by score.
+func (x *Index) SearchMMR(query Embedding, k int, lambda float32) []SearchResult {
+	var similarity = x.Similarity
+	if similarity == nil {
+		similarity = Embedding.Cosine
+	}
+	var candidates = x.Search(query, 4*k)
+	var results []SearchResult
+	// maxSim holds the highest similarity of each candidate to the results.
+	var maxSim = make([]float32, len(candidates))
+	var picked = make([]bool, len(candidates))
+	for len(results) < k && len(results) < len(candidates) {
+		var best = -1
+		var bestScore float32
+		for i, c := range candidates {
+			if picked[i] {
+				continue
+			}
+			var score = lambda * c.Score
+			if len(results) > 0 {
+				score -= (1 - lambda) * maxSim[i]
+			}
+			if best < 0 || score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		picked[best] = true
+		results = append(results, candidates[best])
+		var v = x.vecs[x.pos[candidates[best].ID]]
+		for i, c := range candidates {
+			if s := similarity(x.vecs[x.pos[c.ID]], v); len(results) == 1 || s > maxSim[i] {
+				maxSim[i] = s
+			}
+		}
+	}
+	return results
+}
+
+// Cluster groups the documents of the index into k clusters of similar
+// documents using k-means clustering, with cosine distance as the metric
+// regardless of the Similarity of the index. It returns the ids of the
+// documents in each cluster.
+//
+// The clustering is deterministic: the same index gives the same clusters.
+func (x *Index) Cluster(k int) ([][]string, error) {
+	if k < 1 || k > len(x.vecs) {
+		return nil, fmt.Errorf("cannot make %d clusters of %d documents", k, len(x.vecs))
+	}
+	var assign, _ = kmeans(x.vecs, k, rand.New(rand.NewSource(1)))
+	var clusters = make([][]string, k)
+	for i, c := range assign {
+		clusters[c] = append(clusters[c], x.ids[i])
+	}
+	return clusters, nil
+}
+
+// kmeans runs spherical k-means, which clusters vectors by their direction
+// only. It returns the cluster of each vector and the centroids, which have
+// unit length.
+func kmeans(vecs []Embedding, k int, rng *rand.Rand) (assign []int, centroids []Embedding) {
+	const maxIterations = 100
+
+	// Initialise with k-means++, choosing each new centroid with a
+	// probability proportional to its distance from the ones chosen so far.
+	var first = rng.Intn(len(vecs))
+	centroids = append(centroids, Centroid(vecs[first:first+1], true))
+	var dist = make([]float64, len(vecs))
+	for len(centroids) < k {
+		var sum float64
+		for i, v := range vecs {
+			dist[i] = 1 - float64(v.Cosine(centroids[nearest(v, centroids)]))
+			sum += dist[i]
+		}
+		var i int
+		if sum > 0 {
+			var r = rng.Float64() * sum
+			for i = 0; i < len(vecs)-1 && r > dist[i]; i++ {
+				r -= dist[i]
+			}
+		} else {
+			i = rng.Intn(len(vecs))
+		}
+		centroids = append(centroids, Centroid(vecs[i:i+1], true))
+	}
+
+	assign = make([]int, len(vecs))
+	for iter := 0; iter < maxIterations; iter++ {
+		var changed = iter == 0
+		for i, v := range vecs {
+			if c := nearest(v, centroids); c != assign[i] {
+				assign[i] = c
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+		var members = make([][]Embedding, k)
+		for i, c := range assign {
+			members[c] = append(members[c], vecs[i])
+		}
+		for c := range centroids {
+			if len(members[c]) == 0 {
+				// Move the centroid of an empty cluster to the vector
+				// furthest from its own centroid.
+				var worst int
+				var worstDist float32 = -1
+				for i, v := range vecs {
+					if d := 1 - v.Cosine(centroids[assign[i]]); d > worstDist {
+						worst, worstDist = i, d
+					}
+				}
+				centroids[c] = Centroid(vecs[worst:worst+1], true)
+				assign[worst] = c
+				continue
+			}
+			centroids[c] = Centroid(members[c], true)
+		}
+	}
+	return assign, centroids
+}
+
+// nearest returns the index of the centroid most similar to v.
+func nearest(v Embedding, centroids []Embedding) int {
+	var best int
+	var bestScore float32 = -2
+	for c, centroid := range centroids {
+		if s := v.Cosine(centroid); s > bestScore {
+			best, bestScore = c, s
+		}
+	}
+	return best
+}
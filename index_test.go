@@ -0,0 +1,181 @@
+package gptease_test
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/Volumental/gptease"
+)
+
+func TestIndexSearch(t *testing.T) {
+	var index gptease.Index
+	index.Add("east", gptease.Embedding{1, 0})
+	index.Add("north", gptease.Embedding{0, 1})
+	index.Add("northeast", gptease.Embedding{1, 1})
+
+	var results = index.Search(gptease.Embedding{1, 0.1}, 2)
+	if len(results) != 2 || results[0].ID != "east" || results[1].ID != "northeast" {
+		t.Errorf("Search() = %v, want east and northeast", results)
+	}
+	for _, k := range []int{0, -1} {
+		if results := index.Search(gptease.Embedding{1, 0.1}, k); len(results) != 0 {
+			t.Errorf("Search(%d) = %v, want nothing", k, results)
+		}
+		if results := index.SearchHybrid(gptease.Embedding{1, 0.1}, "east", k, 0.5); len(results) != 0 {
+			t.Errorf("SearchHybrid(%d) = %v, want nothing", k, results)
+		}
+	}
+}
+
+func TestIndexSearchFiltered(t *testing.T) {
+	var index gptease.Index
+	index.AddWithMetadata("east", gptease.Embedding{1, 0}, gptease.Metadata{"source": "wiki"})
+	index.AddWithMetadata("north", gptease.Embedding{0, 1}, gptease.Metadata{"source": "docs"})
+	index.AddWithMetadata("northeast", gptease.Embedding{1, 1}, gptease.Metadata{"source": "docs"})
+	index.Add("nowhere", gptease.Embedding{1, 0.1})
+
+	var results = index.SearchFiltered(gptease.Embedding{1, 0.1}, 2, func(meta gptease.Metadata) bool {
+		return meta["source"] == "docs"
+	})
+	if len(results) != 2 || results[0].ID != "northeast" || results[1].ID != "north" {
+		t.Errorf("SearchFiltered() = %v, want northeast and north", results)
+	}
+}
+
+func TestIndexCluster(t *testing.T) {
+	var index gptease.Index
+	index.Add("a1", gptease.Embedding{1, 0.1, 0})
+	index.Add("b1", gptease.Embedding{0, 1, 0.1})
+	index.Add("a2", gptease.Embedding{2, 0, 0.1})
+	index.Add("c1", gptease.Embedding{0.1, 0, 1})
+	index.Add("b2", gptease.Embedding{0.1, 3, 0})
+	index.Add("c2", gptease.Embedding{0, 0.2, 2})
+
+	clusters, err := index.Cluster(3)
+	if err != nil {
+		t.Fatalf("Cluster() error = %v", err)
+	}
+	var got []string
+	for _, c := range clusters {
+		sort.Strings(c)
+		got = append(got, c[0]+c[1])
+	}
+	sort.Strings(got)
+	if want := []string{"a1a2", "b1b2", "c1c2"}; len(got) != 3 || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("Cluster() = %v, want %v", clusters, want)
+	}
+
+	if _, err := index.Cluster(7); err == nil {
+		t.Errorf("Cluster(7) error = nil, want error")
+	}
+}
+
+func TestIndexSimilarity(t *testing.T) {
+	var index = gptease.Index{Similarity: func(a, b gptease.Embedding) float32 { return -a.Distance(b) }}
+	index.Add("near", gptease.Embedding{1, 0})
+	index.Add("far", gptease.Embedding{10, 0})
+
+	// By cosine similarity, both are equally similar to the query.
+	var results = index.Search(gptease.Embedding{2, 0}, 2)
+	if len(results) != 2 || results[0].ID != "near" || results[0].Score != -1 {
+		t.Errorf("Search() = %v, want near first with score -1", results)
+	}
+}
+
+func TestApproximateIndex(t *testing.T) {
+	var rng = rand.New(rand.NewSource(1))
+	var exact gptease.Index
+	var approx = gptease.NewApproximateIndex(16, 4)
+	for i := 0; i < 1000; i++ {
+		var v = make(gptease.Embedding, 8)
+		for j := range v {
+			v[j] = float32(rng.NormFloat64())
+		}
+		var id = fmt.Sprint(i)
+		exact.Add(id, v)
+		approx.Add(id, v)
+	}
+
+	// The approximate search should mostly find the same nearest neighbours.
+	var found, total int
+	for q := 0; q < 20; q++ {
+		var query = make(gptease.Embedding, 8)
+		for j := range query {
+			query[j] = float32(rng.NormFloat64())
+		}
+		var want = map[string]bool{}
+		for _, r := range exact.Search(query, 10) {
+			want[r.ID] = true
+		}
+		for _, r := range approx.Search(query, 10) {
+			if want[r.ID] {
+				found++
+			}
+		}
+		total += 10
+	}
+	if recall := float64(found) / float64(total); recall < 0.7 {
+		t.Errorf("recall = %.2f, want at least 0.7", recall)
+	}
+}
+
+func TestIndexDelete(t *testing.T) {
+	for _, index := range []*gptease.Index{{}, gptease.NewApproximateIndex(2, 2)} {
+		index.Add("east", gptease.Embedding{1, 0})
+		index.Add("north", gptease.Embedding{0, 1})
+		index.Add("west", gptease.Embedding{-1, 0})
+		index.Add("north", gptease.Embedding{0, -1}) // Now pointing south.
+		if index.Len() != 3 {
+			t.Errorf("Len() = %d, want 3", index.Len())
+		}
+		if !index.Delete("east") || index.Delete("east") {
+			t.Errorf("Delete() didn't report deletion correctly")
+		}
+		var results = index.Search(gptease.Embedding{0.1, -1}, 3)
+		if len(results) != 2 || results[0].ID != "north" || results[1].ID != "west" {
+			t.Errorf("Search() = %v, want north and west", results)
+		}
+	}
+}
+
+func TestIndexSearchMMR(t *testing.T) {
+	var index gptease.Index
+	index.Add("a", gptease.Embedding{1, 0.1, 0})
+	index.Add("a copy", gptease.Embedding{1, 0.11, 0})
+	index.Add("b", gptease.Embedding{1, 0, 0.5})
+
+	if results := index.SearchMMR(gptease.Embedding{1, 0.1, 0}, 2, 1); results[1].ID != "a copy" {
+		t.Errorf("SearchMMR(lambda=1) = %v, want a copy second", results)
+	}
+	if results := index.SearchMMR(gptease.Embedding{1, 0.1, 0.1}, 2, 0.5); results[0].ID != "a" || results[1].ID != "b" {
+		t.Errorf("SearchMMR(lambda=0.5) = %v, want a and b", results)
+	}
+}
+
+func TestIndexSearchHybrid(t *testing.T) {
+	var index gptease.Index
+	index.AddWithText("manual", gptease.Embedding{1, 0}, "How to reset the XR-200 router", nil)
+	index.AddWithText("faq", gptease.Embedding{0.9, 0.1}, "Frequently asked questions about routers", nil)
+	index.Add("blank", gptease.Embedding{0, 1})
+
+	// The embeddings favour the FAQ, but the model number decides it.
+	var query = gptease.Embedding{0.9, 0.12}
+	if results := index.SearchHybrid(query, "XR-200 reset", 3, 0); results[0].ID != "faq" {
+		t.Errorf("SearchHybrid(weight=0) = %v, want faq first", results)
+	}
+	if results := index.SearchHybrid(query, "XR-200 reset", 3, 0.5); results[0].ID != "manual" || results[2].ID != "blank" {
+		t.Errorf("SearchHybrid(weight=0.5) = %v, want manual first and blank last", results)
+	}
+
+	var e = index.SearchHybrid(query, "XR-200 reset", 1, 0.5)[0].Explanation
+	if e.KeywordScore != 1 || len(e.Terms) != 3 || e.Terms[0] != "xr" || len(e.Dimensions) != 2 || e.Dimensions[0] != 0 {
+		t.Errorf("Explanation = %+v", e)
+	}
+
+	index.Delete("manual")
+	if results := index.SearchHybrid(query, "XR-200 reset", 3, 0.5); len(results) != 2 || results[0].ID != "faq" {
+		t.Errorf("SearchHybrid() after Delete = %v, want faq first", results)
+	}
+}
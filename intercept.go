@@ -0,0 +1,27 @@
+package gptease
+
+import (
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Interceptor is called in place of each chat completion request to the API.
+// It's given the request and a function making the actual request, and
+// returns the response or error that the Chat should continue with.
+//
+// It's intended for fault injection in tests, such as returning an error or
+// a malformed response to exercise error handling and retry logic without
+// depending on the real API. It can also observe or modify the actual
+// response by calling next.
+type Interceptor func(req openai.ChatCompletionRequest, next func(openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error)) (openai.ChatCompletionResponse, error)
+
+var interceptor Interceptor
+
+// SetInterceptor sets an interceptor for all chat completion requests made by
+// Chats. Pass nil to remove it.
+//
+// Parts of the response that go-openai doesn't parse, such as refusals, are
+// taken from the actual API response. So if the interceptor doesn't call
+// next, they are missing.
+func SetInterceptor(i Interceptor) {
+	interceptor = i
+}
@@ -0,0 +1,34 @@
+package gptease_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Volumental/gptease"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestInterceptor(t *testing.T) {
+	var api = newFakeAPI(t, `{"choices": [{"message": {"role": "assistant", "content": "Hi"}, "finish_reason": "stop"}]}`)
+	var errOverloaded = errors.New("overloaded")
+	var failures = 1
+	gptease.SetInterceptor(func(req openai.ChatCompletionRequest, next func(openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error)) (openai.ChatCompletionResponse, error) {
+		if failures > 0 {
+			failures--
+			return openai.ChatCompletionResponse{}, errOverloaded
+		}
+		return next(req)
+	})
+	t.Cleanup(func() { gptease.SetInterceptor(nil) })
+
+	var chat gptease.Chat
+	if _, err := chat.Exchange("Hello"); !errors.Is(err, errOverloaded) {
+		t.Fatalf("Exchange() error = %v, want %v", err, errOverloaded)
+	}
+	if len(api.requests) != 0 {
+		t.Errorf("made %d requests, want 0", len(api.requests))
+	}
+	if resp, err := chat.Exchange("Hello"); err != nil || resp != "Hi" {
+		t.Errorf("Exchange() = %q, %v, want %q", resp, err, "Hi")
+	}
+}
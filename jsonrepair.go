@@ -0,0 +1,143 @@
+package gptease
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// RepairJSON attempts to fix common glitches in JSON generated by a model,
+// such as trailing commas, a surrounding Markdown code block, or output that
+// was cut off before all strings, arrays and objects were closed. Valid JSON
+// is returned unchanged.
+//
+// The result is not guaranteed to be valid, and when it is, the meaning may
+// not be what the model intended. Use it with care.
+func RepairJSON(s string) string {
+	if json.Valid([]byte(s)) {
+		return s
+	}
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "```") {
+		s = strings.TrimPrefix(s, "```json")
+		s = strings.TrimPrefix(s, "```")
+		s = strings.TrimSuffix(s, "```")
+		s = strings.TrimSpace(s)
+	}
+
+	type scope struct {
+		close     byte
+		expectKey bool
+	}
+	var (
+		out      strings.Builder
+		stack    []scope
+		inString bool
+		escaped  bool
+		isKey    bool
+	)
+	// trimComma removes a trailing comma, along with any whitespace after it.
+	var trimComma = func() {
+		var t = strings.TrimRight(out.String(), " \t\r\n")
+		if strings.HasSuffix(t, ",") {
+			t = t[:len(t)-1]
+			out.Reset()
+			out.WriteString(t)
+		}
+	}
+	for i := 0; i < len(s); i++ {
+		var ch = s[i]
+		if inString {
+			out.WriteByte(ch)
+			switch {
+			case escaped:
+				escaped = false
+			case ch == '\\':
+				escaped = true
+			case ch == '"':
+				inString = false
+			}
+			continue
+		}
+		switch ch {
+		case '"':
+			inString = true
+			isKey = len(stack) > 0 && stack[len(stack)-1].expectKey
+		case '{':
+			stack = append(stack, scope{close: '}', expectKey: true})
+		case '[':
+			stack = append(stack, scope{close: ']'})
+		case '}', ']':
+			trimComma()
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case ':':
+			if len(stack) > 0 {
+				stack[len(stack)-1].expectKey = false
+			}
+		case ',':
+			if len(stack) > 0 && stack[len(stack)-1].close == '}' {
+				stack[len(stack)-1].expectKey = true
+			}
+		}
+		out.WriteByte(ch)
+	}
+
+	// Close whatever was left open when the text was cut off.
+	if inString {
+		if escaped {
+			var t = out.String()
+			out.Reset()
+			out.WriteString(t[:len(t)-1])
+		}
+		out.WriteByte('"')
+		if isKey {
+			out.WriteString(": null")
+		}
+	}
+	var t = strings.TrimRight(out.String(), " \t\r\n")
+	for _, lit := range []string{"true", "false", "null"} {
+		for n := len(lit) - 1; n > 0; n-- {
+			if strings.HasSuffix(t, lit[:n]) && !isLiteralChar(t, len(t)-n-1) {
+				t += lit[n:]
+				break
+			}
+		}
+	}
+	t = strings.TrimSuffix(t, ",")
+	if strings.HasSuffix(t, ":") {
+		t += " null"
+	}
+	out.Reset()
+	out.WriteString(t)
+	for i := len(stack) - 1; i >= 0; i-- {
+		trimComma()
+		out.WriteByte(stack[i].close)
+	}
+	return out.String()
+}
+
+// isLiteralChar reports whether the character at index i in s is a letter,
+// meaning a literal doesn't start right after it.
+func isLiteralChar(s string, i int) bool {
+	return i >= 0 && (s[i] >= 'a' && s[i] <= 'z' || s[i] >= 'A' && s[i] <= 'Z')
+}
+
+// CanonicalJSON formats JSON deterministically, with the keys of objects
+// sorted and consistent indentation, so that equivalent JSON is formatted the
+// same regardless of how it was generated. This is useful for comparing the
+// arguments of tool calls in snapshot tests. Invalid JSON is returned
+// unchanged.
+func CanonicalJSON(s string) string {
+	var dec = json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		return s
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return s
+	}
+	return string(b)
+}
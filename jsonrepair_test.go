@@ -0,0 +1,46 @@
+package gptease_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Volumental/gptease"
+)
+
+func TestRepairJSON(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`{"a": 1}`, `{"a": 1}`},
+		{`{"a": 1,}`, `{"a": 1}`},
+		{`[1, 2, 3, ]`, `[1, 2, 3]`},
+		{"```json\n{\"a\": 1}\n```", `{"a": 1}`},
+		{`{"a": [1, 2`, `{"a": [1, 2]}`},
+		{`{"a": "hel`, `{"a": "hel"}`},
+		{`{"a": "x\`, `{"a": "x"}`},
+		{`{"a": 1, "b`, `{"a": 1, "b": null}`},
+		{`{"a":`, `{"a": null}`},
+		{`{"a": tr`, `{"a": true}`},
+		{`{"a": {"b": [{"c": 1},`, `{"a": {"b": [{"c": 1}]}}`},
+		{`{"a": "}],"`, `{"a": "}],"}`},
+	}
+	for _, tt := range tests {
+		if got := gptease.RepairJSON(tt.in); !jsonEquals(got, tt.want) {
+			t.Errorf("RepairJSON(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	var a = gptease.CanonicalJSON(`{"b": 1, "a": {"d": [1, 2], "c": 12345678901234567}}`)
+	var b = gptease.CanonicalJSON(`{"a":{"c":12345678901234567,"d":[1,2]},"b":1}`)
+	if a != b {
+		t.Errorf("CanonicalJSON() = %s and %s, want them equal", a, b)
+	}
+	if !strings.Contains(a, "12345678901234567") {
+		t.Errorf("CanonicalJSON() = %s, large number was mangled", a)
+	}
+	if got := gptease.CanonicalJSON(`{"a": `); got != `{"a": ` {
+		t.Errorf("CanonicalJSON(invalid) = %q, want it unchanged", got)
+	}
+}
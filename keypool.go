@@ -0,0 +1,161 @@
+package gptease
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// keyCooldown is how long a key is avoided after a 429 Too Many Requests
+// response, unless the response says how long to wait.
+const keyCooldown = 10 * time.Second
+
+// NewClientWithKeys creates an OpenAI API client that distributes requests
+// over several API keys, for example from different organizations, to get
+// more capacity than the rate limits of a single key allow. The key in the
+// configuration is not used.
+//
+// Each request uses the key with the fewest requests in progress, taking
+// turns between keys that are equally loaded. When a request is rejected
+// with 429 Too Many Requests, its key is avoided for a while, as long as the
+// response says or 10 seconds otherwise, and the request is retried with
+// another key. If all keys have been rejected, the last rejection is
+// returned.
+//
+// Use SetDefaultClient to make chats use the client.
+func NewClientWithKeys(config openai.ClientConfig, keys []string) *openai.Client {
+	if len(keys) == 0 {
+		panic("no API keys")
+	}
+	var pool = &keyPool{}
+	for _, k := range keys {
+		pool.keys = append(pool.keys, &poolKey{key: k})
+	}
+	return newClient(config, pool)
+}
+
+type keyPool struct {
+	mu   sync.Mutex
+	keys []*poolKey
+	// next is where to start looking for the least loaded key, so that
+	// equally loaded keys take turns.
+	next int
+}
+
+type poolKey struct {
+	key       string
+	inFlight  int
+	coolUntil time.Time
+}
+
+// acquire picks the key to use for a request, skipping those already
+// tried, of which there must be at least one left. Keys cooling down after a
+// rejection are only picked if all are, in which case the one that's done
+// cooling down first is picked.
+func (p *keyPool) acquire(tried map[*poolKey]bool) *poolKey {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var now = time.Now()
+	var best *poolKey
+	var better = func(k *poolKey) bool {
+		if best == nil {
+			return true
+		}
+		var cooling, bestCooling = now.Before(k.coolUntil), now.Before(best.coolUntil)
+		switch {
+		case cooling != bestCooling:
+			return !cooling
+		case cooling:
+			return k.coolUntil.Before(best.coolUntil)
+		default:
+			return k.inFlight < best.inFlight
+		}
+	}
+	for i := range p.keys {
+		var k = p.keys[(p.next+i)%len(p.keys)]
+		if !tried[k] && better(k) {
+			best = k
+		}
+	}
+	p.next = (p.next + 1) % len(p.keys)
+	best.inFlight++
+	return best
+}
+
+func (p *keyPool) release(k *poolKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	k.inFlight--
+}
+
+func (p *keyPool) coolDown(k *poolKey, d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	k.coolUntil = time.Now().Add(d)
+}
+
+// retryAfter returns how long a 429 response says to wait.
+func retryAfter(resp *http.Response) time.Duration {
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	return keyCooldown
+}
+
+// roundTripWithKeys makes a request with a key from the pool, retrying
+// with other keys on 429 Too Many Requests.
+func (t *transport) roundTripWithKeys(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var tried = map[*poolKey]bool{}
+	for {
+		var k = t.keys.acquire(tried)
+		tried[k] = true
+		var r = req.Clone(req.Context())
+		r.Header.Set("Authorization", "Bearer "+k.key)
+		if body != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		resp, err := t.roundTrip(r)
+		if err != nil {
+			t.keys.release(k)
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusTooManyRequests {
+			// The request is in progress until its response has been read,
+			// which matters for streams.
+			resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() { t.keys.release(k) }}
+			return resp, nil
+		}
+		t.keys.release(k)
+		t.keys.coolDown(k, retryAfter(resp))
+		if len(tried) == len(t.keys.keys) {
+			return resp, nil
+		}
+		resp.Body.Close()
+	}
+}
+
+// releasingBody calls release once the body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,57 @@
+package gptease_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/Volumental/gptease"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestNewClientWithKeys(t *testing.T) {
+	var mu sync.Mutex
+	var used []string
+	var srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var key = r.Header.Get("Authorization")
+		used = append(used, key)
+		if key == "Bearer limited" {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, `{"error": {"message": "rate limited"}}`, http.StatusTooManyRequests)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if len(body) == 0 {
+			http.Error(w, `{"error": {"message": "no body"}}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"choices": [{"message": {"role": "assistant", "content": "Hi."}, "finish_reason": "stop"}]}`)
+	}))
+	defer srv.Close()
+	var config = openai.DefaultConfig("unused")
+	config.BaseURL = srv.URL + "/v1"
+	gptease.SetDefaultClient(gptease.NewClientWithKeys(config, []string{"a", "limited", "b"}))
+
+	for i := 0; i < 4; i++ {
+		var chat gptease.Chat
+		if _, err := chat.Exchange("Hello"); err != nil {
+			t.Fatalf("Exchange() error = %v", err)
+		}
+	}
+	// Keys take turns, and the rate limited one is retried with the next
+	// key, and then avoided.
+	var want = []string{"Bearer a", "Bearer limited", "Bearer b", "Bearer a", "Bearer b"}
+	if len(used) != len(want) {
+		t.Fatalf("used keys %v, want %v", used, want)
+	}
+	for i := range want {
+		if used[i] != want[i] {
+			t.Fatalf("used keys %v, want %v", used, want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package gptease
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// BM25 parameters, with the values commonly used.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// keywordIndex scores texts by how well they match the terms of a query,
+// using BM25. Texts are identified by their position, like the documents of
+// an Index. The zero value is an empty index ready to use.
+type keywordIndex struct {
+	// terms holds the number of occurrences of each term in each text, and
+	// lengths the number of terms in each text.
+	terms   []map[string]int
+	lengths []int
+	// docFreq is the number of texts containing each term, and totalLength
+	// the total number of terms in all texts.
+	docFreq     map[string]int
+	totalLength int
+}
+
+// keywordTerms splits a text into lower case words.
+func keywordTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func (k *keywordIndex) add(text string) {
+	k.terms = append(k.terms, nil)
+	k.lengths = append(k.lengths, 0)
+	k.set(len(k.terms)-1, text)
+}
+
+// set replaces the text at position i.
+func (k *keywordIndex) set(i int, text string) {
+	k.forget(i)
+	var tf = map[string]int{}
+	var terms = keywordTerms(text)
+	for _, t := range terms {
+		tf[t]++
+	}
+	if k.docFreq == nil {
+		k.docFreq = map[string]int{}
+	}
+	for t := range tf {
+		k.docFreq[t]++
+	}
+	k.terms[i] = tf
+	k.lengths[i] = len(terms)
+	k.totalLength += len(terms)
+}
+
+// remove removes the text at position i, which is replaced by the last
+// text, at position last.
+func (k *keywordIndex) remove(i, last int) {
+	k.forget(i)
+	k.terms[i], k.lengths[i] = k.terms[last], k.lengths[last]
+	k.terms, k.lengths = k.terms[:last], k.lengths[:last]
+}
+
+// forget removes the text at position i from the statistics.
+func (k *keywordIndex) forget(i int) {
+	for t := range k.terms[i] {
+		if k.docFreq[t]--; k.docFreq[t] == 0 {
+			delete(k.docFreq, t)
+		}
+	}
+	k.totalLength -= k.lengths[i]
+	k.terms[i] = nil
+	k.lengths[i] = 0
+}
+
+// scores returns the BM25 score of each text for the query.
+func (k *keywordIndex) scores(query string) []float32 {
+	var scores = make([]float32, len(k.terms))
+	if len(k.terms) == 0 || k.totalLength == 0 {
+		return scores
+	}
+	var n = float64(len(k.terms))
+	var avgLength = float64(k.totalLength) / n
+	for _, t := range keywordTerms(query) {
+		var df = float64(k.docFreq[t])
+		if df == 0 {
+			continue
+		}
+		var idf = math.Log(1 + (n-df+0.5)/(df+0.5))
+		for i, tf := range k.terms {
+			var f = float64(tf[t])
+			if f == 0 {
+				continue
+			}
+			var norm = 1 - bm25B + bm25B*float64(k.lengths[i])/avgLength
+			scores[i] += float32(idf * f * (bm25K1 + 1) / (f + bm25K1*norm))
+		}
+	}
+	return scores
+}
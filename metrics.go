@@ -0,0 +1,34 @@
+package gptease
+
+// Metrics receives counts of what the package is doing, to be passed on to a
+// monitoring system such as Prometheus. Implementations must be safe for
+// concurrent use.
+type Metrics interface {
+	// IncRequests is called for each request made to the API.
+	IncRequests(model string)
+	// AddTokens is called with the token usage reported for each request.
+	AddTokens(model string, promptTokens, completionTokens int)
+	// IncToolCalls is called each time the AI calls a tool.
+	IncToolCalls(tool string)
+	// IncErrors is called for each error, with one of the kinds "api",
+	// "refusal", "content_filter", "not_finished", "token_limit",
+	// "unexpected_response", "tool" and "unknown_tool".
+	IncErrors(kind string)
+}
+
+var metrics Metrics = noMetrics{}
+
+// SetMetrics sets where to report metrics. Pass nil to stop reporting.
+func SetMetrics(m Metrics) {
+	if m == nil {
+		m = noMetrics{}
+	}
+	metrics = m
+}
+
+type noMetrics struct{}
+
+func (noMetrics) IncRequests(string)         {}
+func (noMetrics) AddTokens(string, int, int) {}
+func (noMetrics) IncToolCalls(string)        {}
+func (noMetrics) IncErrors(string)           {}
@@ -0,0 +1,65 @@
+package gptease_test
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/Volumental/gptease"
+)
+
+// countingMetrics counts the calls made to it by name and argument.
+type countingMetrics struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (m *countingMetrics) inc(key string, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[key] += n
+}
+
+func (m *countingMetrics) IncRequests(model string) { m.inc("requests:"+model, 1) }
+func (m *countingMetrics) AddTokens(model string, prompt, completion int) {
+	m.inc("tokens:"+model, prompt+completion)
+}
+func (m *countingMetrics) IncToolCalls(tool string) { m.inc("tool_calls:"+tool, 1) }
+func (m *countingMetrics) IncErrors(kind string)    { m.inc("errors:"+kind, 1) }
+
+func TestSetMetrics(t *testing.T) {
+	newFakeAPI(t,
+		`{"choices": [{"message": {"role": "assistant", "tool_calls": [
+			{"id": "call_1", "type": "function", "function": {"name": "time", "arguments": "{}"}}
+		]}, "finish_reason": "tool_calls"}], "usage": {"prompt_tokens": 10, "completion_tokens": 5, "total_tokens": 15}}`,
+		`{"choices": [{"message": {"role": "assistant", "content": "Noon."}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 20, "completion_tokens": 2, "total_tokens": 22}}`,
+	)
+	var m = &countingMetrics{counts: map[string]int{}}
+	gptease.SetMetrics(m)
+	t.Cleanup(func() { gptease.SetMetrics(nil) })
+
+	var chat = gptease.Chat{
+		Model: "test-model",
+		Tools: []gptease.Tool{{
+			Name:       "time",
+			Parameters: `{"type": "object"}`,
+			Handler:    func(string) (string, error) { return "12:00", nil },
+		}},
+	}
+	if _, err := chat.Exchange("What time is it?"); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	// The fake API has no more responses, so this fails.
+	if _, err := chat.Exchange("And now?"); err == nil {
+		t.Fatalf("Exchange() error = nil, want error")
+	}
+	var want = map[string]int{
+		"requests:test-model": 3,
+		"tokens:test-model":   37,
+		"tool_calls:time":     1,
+		"errors:api":          1,
+	}
+	if !reflect.DeepEqual(m.counts, want) {
+		t.Errorf("metrics = %v, want %v", m.counts, want)
+	}
+}
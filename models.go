@@ -0,0 +1,58 @@
+package gptease
+
+import (
+	"errors"
+	"sync"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// ErrToolsUnsupported is returned when talking with tools to a model that
+// is known not to support them. Use SetModelCapabilities to tell what a
+// model supports.
+var ErrToolsUnsupported = errors.New("model doesn't support tools")
+
+// ModelCapabilities describes what features a model supports.
+type ModelCapabilities struct {
+	// Tools tells whether the model supports tool calls.
+	Tools bool
+}
+
+var (
+	capabilitiesMu sync.RWMutex
+	// capabilities holds the capabilities of some models, mainly those
+	// lacking features. Models not listed are assumed to support
+	// everything, leaving it to the API to complain if they don't.
+	capabilities = map[string]ModelCapabilities{
+		openai.GPT4:              {Tools: true},
+		openai.GPT3Dot5Turbo:     {Tools: true},
+		openai.GPT4TurboPreview:  {Tools: true},
+		openai.GPT3Dot5Turbo1106: {Tools: true},
+		openai.GPT4Turbo0125:     {Tools: true},
+		openai.GPT4Turbo1106:     {Tools: true},
+		openai.GPT40314:          {Tools: false},
+		openai.GPT432K0314:       {Tools: false},
+		openai.GPT3Dot5Turbo0301: {Tools: false},
+		openai.GPT4VisionPreview: {Tools: false},
+		"o1-preview":             {Tools: false},
+		"o1-preview-2024-09-12":  {Tools: false},
+		"o1-mini":                {Tools: false},
+		"o1-mini-2024-09-12":     {Tools: false},
+	}
+)
+
+// SetModelCapabilities sets what features a model supports, so that using
+// features it doesn't support fails early with a clear error.
+func SetModelCapabilities(model string, caps ModelCapabilities) {
+	capabilitiesMu.Lock()
+	defer capabilitiesMu.Unlock()
+	capabilities[model] = caps
+}
+
+// CapabilitiesOf returns the capabilities of a model, if known.
+func CapabilitiesOf(model string) (caps ModelCapabilities, ok bool) {
+	capabilitiesMu.RLock()
+	defer capabilitiesMu.RUnlock()
+	caps, ok = capabilities[model]
+	return caps, ok
+}
@@ -0,0 +1,192 @@
+package gptease
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Plan is a sequence of tool calls that the AI intends to make to respond to
+// a message, as returned by Chat.Plan.
+type Plan struct {
+	// Request is the message from the user that the plan responds to.
+	Request string
+	Steps   []PlanStep
+}
+
+// PlanStep is one tool call in a Plan.
+type PlanStep struct {
+	Tool string `json:"tool"`
+	// Arguments is the input to the tool, as JSON.
+	Arguments string `json:"arguments"`
+	// Reason is why the AI wants to call the tool, for the benefit of
+	// whoever reviews the plan.
+	Reason string `json:"reason"`
+}
+
+const planInstruction = `Before responding to the next message from the user, plan which tools to call. Don't respond to the message, just list the calls to make, in order, with the arguments of each as a JSON object matching the parameters of the tool, and the reason for making it. List no calls if no tools are needed. The tools are:`
+
+// Plan asks the AI which of the tools of the chat it intends to call, and
+// with what arguments, to respond to the content, without calling any of
+// them. This gives a chance to inspect what the AI is about to do before
+// anything with side effects happens. Pass the plan to ExecutePlan to carry
+// it out, possibly after adjusting it, or simply drop it. The dialogue is
+// left unchanged either way.
+//
+// Since nothing is called while planning, the AI can't base later steps on
+// the outputs of earlier ones. It can still call more tools once the plan
+// has been executed, as usual, to complete its response.
+//
+// Planning uses structured output, so like ExchangeInto it requires a client
+// created by this package, see NewClient, and a model that supports it. The
+// arguments of the steps are checked against the parameters of the tools,
+// failing with ErrUnexpectedResponse if they don't match.
+func (c *Chat) Plan(content string) (Plan, error) {
+	if len(c.Tools) == 0 {
+		return Plan{}, fmt.Errorf("no tools to plan with")
+	}
+	var names []any
+	var desc strings.Builder
+	desc.WriteString(planInstruction)
+	for _, t := range c.Tools {
+		names = append(names, t.Name)
+		fmt.Fprintf(&desc, "\n\n%s: %s\nParameters: %s", t.Name, t.Description, t.Parameters)
+	}
+	var schema = fieldSpec{
+		Type: "object",
+		Properties: &fieldMap{"steps": {
+			Type: "array",
+			Items: &fieldSpec{
+				Type: "object",
+				Properties: &fieldMap{
+					"tool":      {Type: "string", Enum: names},
+					"arguments": {Type: "string", Description: "the arguments as a JSON object"},
+					"reason":    {Type: "string"},
+				},
+				Required: []string{"tool", "arguments", "reason"},
+			},
+		}},
+		Required: []string{"steps"},
+	}
+
+	// Plan in a copy of the chat, without tools, so that the AI can't call
+	// them, and so that the dialogue is left as it was.
+	var planner = c.Clone()
+	planner.Tools = nil
+	// Any tool choice is for executing the plan, and can't be made without
+	// tools anyway.
+	planner.toolChoice = nil
+	planner.Instruction(desc.String())
+	var opts = planner.options()
+	opts.setField("response_format", responseFormat("plan", "", schema))
+	resp, err := planner.exchange(content, &opts)
+	// Planning is a turn of its own, as far as usage is concerned.
+	c.usage, c.turns = planner.usage, planner.turns
+	if err != nil {
+		return Plan{}, err
+	}
+	var out struct {
+		Steps []PlanStep `json:"steps"`
+	}
+	if err := json.Unmarshal([]byte(resp), &out); err != nil {
+		return Plan{}, fmt.Errorf("%w: %v", ErrUnexpectedResponse, err)
+	}
+	for i, s := range out.Steps {
+		if err := checkStep(s, c.Tools); err != nil {
+			return Plan{}, fmt.Errorf("step %d: %w", i+1, err)
+		}
+	}
+	return Plan{Request: content, Steps: out.Steps}, nil
+}
+
+// checkStep checks that a step calls a known tool with arguments matching
+// its parameters.
+func checkStep(s PlanStep, tools []Tool) error {
+	var t = findTool(s.Tool, tools)
+	if t == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownTool, s.Tool)
+	}
+	var schema, args any
+	if err := json.Unmarshal([]byte(t.Parameters), &schema); err != nil {
+		return fmt.Errorf("tool %s: %w", t.Name, err)
+	}
+	if err := json.Unmarshal([]byte(s.Arguments), &args); err != nil {
+		return fmt.Errorf("%w: arguments of %s: %v", ErrUnexpectedResponse, t.Name, err)
+	}
+	var errs SchemaErrors
+	validateValue("arguments", schema, args, &errs)
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %s: %v", ErrUnexpectedResponse, t.Name, errs)
+	}
+	return nil
+}
+
+// ExecutePlan carries out a plan made by Plan. The request of the plan is
+// added to the dialogue, followed by the planned tool calls and their
+// outputs, as if the AI had made the calls itself. The AI is then asked to
+// respond, and may call further tools to do so. Like Exchange, the dialogue
+// is left unchanged if this fails.
+//
+// Executing a plan counts as approving it, so tools requiring approval, see
+// Tool.RequiresApproval, are called without asking again. They do require
+// approval if the AI calls them beyond the plan.
+func (c *Chat) ExecutePlan(p Plan) (response string, err error) {
+	defer c.watchDialogue()()
+	if c.pending != nil {
+		return "", fmt.Errorf("a tool call is awaiting approval, call Resume first")
+	}
+	if p.Request == "" {
+		return "", fmt.Errorf("empty content")
+	}
+	for i, s := range p.Steps {
+		if err := checkStep(s, c.Tools); err != nil {
+			return "", fmt.Errorf("step %d: %w", i+1, err)
+		}
+	}
+	var before = c.Dialogue
+	c.addDefaultInstruction()
+	c.UserSaid(p.Request)
+	c.startTurn()
+	var opts = c.options()
+	if response, err = c.executePlan(p, &opts); err != nil {
+		if !errors.Is(err, ErrApprovalRequired) || c.pending == nil {
+			c.Dialogue = before
+		}
+		return "", err
+	}
+	return response, nil
+}
+
+func (c *Chat) executePlan(p Plan, opts *talkOptions) (string, error) {
+	if len(p.Steps) > 0 {
+		var calls = make([]openai.ToolCall, len(p.Steps))
+		for i, s := range p.Steps {
+			calls[i] = openai.ToolCall{
+				// The length of the dialogue makes the ids unique within it,
+				// even when executing several plans.
+				ID:   fmt.Sprintf("plan_%d_%d", len(c.Dialogue), i+1),
+				Type: "function",
+				Function: openai.FunctionCall{
+					Name:      s.Tool,
+					Arguments: s.Arguments,
+				},
+			}
+		}
+		c.toolRounds++
+		c.Dialogue = append(c.Dialogue, openai.ChatCompletionMessage{
+			Role:      openai.ChatMessageRoleAssistant,
+			ToolCalls: calls,
+		})
+		for _, call := range calls {
+			content, err := c.callTool(opts.ctx, call, opts.tools)
+			if err != nil {
+				return "", err
+			}
+			c.toolSaid(call.ID, content)
+		}
+	}
+	return c.converse(opts)
+}
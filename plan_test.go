@@ -0,0 +1,103 @@
+package gptease_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/Volumental/gptease"
+)
+
+func TestPlan(t *testing.T) {
+	var api = newFakeAPI(t,
+		`{"choices": [{"message": {"role": "assistant", "content": "{\"steps\": [{\"tool\": \"send\", \"arguments\": \"{\\\"amount\\\": 10}\", \"reason\": \"to pay\"}]}"}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 50, "completion_tokens": 20, "total_tokens": 70}}`,
+		`{"choices": [{"message": {"role": "assistant", "content": "Sent."}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 60, "completion_tokens": 2, "total_tokens": 62}}`,
+	)
+	var sent string
+	var chat = gptease.Chat{
+		Tools: []gptease.Tool{{
+			Name:       "send",
+			Parameters: `{"type": "object", "properties": {"amount": {"type": "integer"}}, "required": ["amount"]}`,
+			Handler: func(input string) (string, error) {
+				sent = input
+				return "ok", nil
+			},
+			RequiresApproval: true,
+		}},
+	}
+	plan, err := chat.Plan("Pay Bob 10.")
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if len(plan.Steps) != 1 || plan.Steps[0].Tool != "send" || plan.Steps[0].Reason != "to pay" {
+		t.Fatalf("Plan() = %+v", plan)
+	}
+	if sent != "" || len(chat.Dialogue) != 0 {
+		t.Fatalf("Plan() called the tool or changed the dialogue: %q, %v", sent, chat.Dialogue)
+	}
+	if _, ok := api.requests[0]["tools"]; ok {
+		t.Errorf("planning request has tools, want none")
+	}
+
+	resp, err := chat.ExecutePlan(plan)
+	if err != nil {
+		t.Fatalf("ExecutePlan() error = %v", err)
+	}
+	if resp != "Sent." || sent != `{"amount": 10}` {
+		t.Errorf("ExecutePlan() = %q, tool input %q", resp, sent)
+	}
+	// User message, planned calls, tool output, response.
+	if len(chat.Dialogue) != 4 || chat.Dialogue[1].ToolCalls[0].ID != chat.Dialogue[2].ToolCallID {
+		t.Errorf("Dialogue = %+v", chat.Dialogue)
+	}
+	if turns := chat.UsageByTurn(); len(turns) != 2 || turns[0].TotalTokens != 70 || turns[1].TotalTokens != 62 {
+		t.Errorf("UsageByTurn() = %+v, want planning and executing", turns)
+	}
+}
+
+func TestPlanInvalidArguments(t *testing.T) {
+	newFakeAPI(t,
+		`{"choices": [{"message": {"role": "assistant", "content": "{\"steps\": [{\"tool\": \"send\", \"arguments\": \"{\\\"amount\\\": \\\"ten\\\"}\", \"reason\": \"to pay\"}]}"}, "finish_reason": "stop"}]}`,
+	)
+	var chat = gptease.Chat{
+		Tools: []gptease.Tool{{
+			Name:       "send",
+			Parameters: `{"type": "object", "properties": {"amount": {"type": "integer"}}}`,
+			Handler:    func(string) (string, error) { return "ok", nil },
+		}},
+	}
+	if _, err := chat.Plan("Pay Bob 10."); !errors.Is(err, gptease.ErrUnexpectedResponse) {
+		t.Errorf("Plan() error = %v, want %v", err, gptease.ErrUnexpectedResponse)
+	}
+}
+
+func TestExecutePlanTwice(t *testing.T) {
+	const ok = `{"choices": [{"message": {"role": "assistant", "content": "Done."}, "finish_reason": "stop"}]}`
+	newFakeAPI(t, ok, ok)
+	var count int
+	var chat = gptease.Chat{
+		Tools: []gptease.Tool{{
+			Name:       "count",
+			Parameters: `{"type": "object"}`,
+			Handler: func(string) (string, error) {
+				count++
+				return fmt.Sprint(count), nil
+			},
+		}},
+	}
+	var plan = gptease.Plan{Request: "Count.", Steps: []gptease.PlanStep{{Tool: "count", Arguments: "{}"}}}
+	for i := 0; i < 2; i++ {
+		if _, err := chat.ExecutePlan(plan); err != nil {
+			t.Fatalf("ExecutePlan() error = %v", err)
+		}
+	}
+	if id1, id2 := chat.Dialogue[2].ToolCallID, chat.Dialogue[6].ToolCallID; id1 == id2 {
+		t.Fatalf("tool call ids of both plans = %q", id1)
+	}
+	if err := chat.RerunTools(); err != nil {
+		t.Fatalf("RerunTools() error = %v", err)
+	}
+	if first, second := chat.Dialogue[2].Content, chat.Dialogue[6].Content; first != "3" || second != "4" {
+		t.Errorf("tool results after RerunTools() = %q, %q, want 3 and 4", first, second)
+	}
+}
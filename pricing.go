@@ -0,0 +1,77 @@
+package gptease
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// ErrUnknownPrice is returned when estimating the cost of using a model
+// whose price isn't known. Use SetModelPrice to provide it.
+var ErrUnknownPrice = errors.New("unknown model price")
+
+// ModelPrice is the price of using a model, in USD per million tokens.
+type ModelPrice struct {
+	Prompt     float64
+	Completion float64
+}
+
+var (
+	pricesMu sync.RWMutex
+	// prices holds the list prices of some common models. They are bound to
+	// change over time, so use SetModelPrice if you need accurate numbers.
+	prices = map[string]ModelPrice{
+		openai.GPT4TurboPreview:        {Prompt: 10, Completion: 30},
+		openai.GPT4Turbo0125:           {Prompt: 10, Completion: 30},
+		openai.GPT4Turbo1106:           {Prompt: 10, Completion: 30},
+		openai.GPT4:                    {Prompt: 30, Completion: 60},
+		openai.GPT40613:                {Prompt: 30, Completion: 60},
+		openai.GPT432K:                 {Prompt: 60, Completion: 120},
+		openai.GPT3Dot5Turbo:           {Prompt: 0.5, Completion: 1.5},
+		"gpt-3.5-turbo-0125":           {Prompt: 0.5, Completion: 1.5},
+		openai.GPT3Dot5Turbo1106:       {Prompt: 1, Completion: 2},
+		string(openai.SmallEmbedding3): {Prompt: 0.02},
+		string(openai.LargeEmbedding3): {Prompt: 0.13},
+	}
+)
+
+// SetModelPrice sets the price of a model, used for cost estimates.
+func SetModelPrice(model string, price ModelPrice) {
+	pricesMu.Lock()
+	defer pricesMu.Unlock()
+	prices[model] = price
+}
+
+// PriceOf returns the price of a model, if known.
+func PriceOf(model string) (price ModelPrice, ok bool) {
+	pricesMu.RLock()
+	defer pricesMu.RUnlock()
+	price, ok = prices[model]
+	return price, ok
+}
+
+// Cost computes the cost in USD of a number of prompt and completion tokens.
+func (p ModelPrice) Cost(promptTokens, completionTokens int) float64 {
+	return (float64(promptTokens)*p.Prompt + float64(completionTokens)*p.Completion) / 1e6
+}
+
+// EstimatePromptCost estimates the cost in USD of the prompt of the next
+// request, that is, of sending the dialogue so far and the tool definitions.
+// The cost of the response comes on top of that, but can't be known until
+// it's been generated. The DefaultInstruction is included if it would be
+// added to the dialogue.
+//
+// The estimate is based on the tokenizer for the model, see TokenizerFor, and
+// its price, see SetModelPrice.
+func (c *Chat) EstimatePromptCost() (float64, error) {
+	var opts = c.options()
+	opts.defaultInstruction = true
+	var req = c.request(&opts, c.Tweaks)
+	price, ok := PriceOf(req.Model)
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownPrice, req.Model)
+	}
+	return price.Cost(promptTokens(req), 0), nil
+}
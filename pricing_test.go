@@ -0,0 +1,35 @@
+package gptease_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Volumental/gptease"
+)
+
+func TestEstimatePromptCost(t *testing.T) {
+	gptease.RegisterTokenizer("priced-words", wordCounter{})
+	// A price of a dollar per token makes the cost the number of tokens.
+	gptease.SetModelPrice("priced-words", gptease.ModelPrice{Prompt: 1e6, Completion: 2e6})
+	var chat = gptease.Chat{Model: "priced-words"}
+	chat.UserSaid("one two three")
+	// 3 tokens for the message, 1 for its role and 3 for its content, plus
+	// 3 priming the response.
+	if cost, err := chat.EstimatePromptCost(); err != nil || cost != 10 {
+		t.Errorf("EstimatePromptCost() = %v, %v, want 10", cost, err)
+	}
+
+	gptease.DefaultInstruction = "Be brief."
+	t.Cleanup(func() { gptease.DefaultInstruction = "" })
+	if cost, err := chat.EstimatePromptCost(); err != nil || cost != 16 {
+		t.Errorf("EstimatePromptCost() with default instruction = %v, %v, want 16", cost, err)
+	}
+	if len(chat.Dialogue) != 1 {
+		t.Errorf("len(Dialogue) = %d, want 1", len(chat.Dialogue))
+	}
+
+	chat.Model = "unpriced-model"
+	if _, err := chat.EstimatePromptCost(); !errors.Is(err, gptease.ErrUnknownPrice) {
+		t.Errorf("EstimatePromptCost() error = %v, want %v", err, gptease.ErrUnknownPrice)
+	}
+}
@@ -0,0 +1,129 @@
+package gptease
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+var defaultRateLimiter *RateLimiter
+
+// SetDefaultRateLimiter sets the rate limiter used by all Chats that don't
+// have a RateLimiter of their own. Pass nil to disable rate limiting.
+func SetDefaultRateLimiter(l *RateLimiter) {
+	defaultRateLimiter = l
+}
+
+// RateLimiter keeps the number of requests and tokens sent to the OpenAI API
+// within a requests-per-minute (RPM) and a tokens-per-minute (TPM) limit. It
+// uses one token bucket for each limit, so short bursts are allowed as long
+// as the average rate stays within the limits.
+//
+// Rather than reacting to 429 Too Many Requests responses, calls will block
+// until there is enough capacity. A RateLimiter is safe for concurrent use
+// and is typically shared by all Chats using the same API key.
+type RateLimiter struct {
+	mu       sync.Mutex
+	requests bucket
+	tokens   bucket
+}
+
+// NewRateLimiter creates a rate limiter allowing rpm requests and tpm tokens
+// per minute. A limit of zero means that particular limit is not enforced.
+func NewRateLimiter(rpm, tpm int) *RateLimiter {
+	var now = time.Now()
+	return &RateLimiter{
+		requests: newBucket(rpm, now),
+		tokens:   newBucket(tpm, now),
+	}
+}
+
+// Wait blocks until there is capacity for one more request costing the given
+// number of tokens, and then consumes that capacity. It returns an error only
+// if the context is done before that happens.
+//
+// A request costing more tokens than the TPM limit will wait for a completely
+// full bucket, rather than forever.
+func (l *RateLimiter) Wait(ctx context.Context, tokens int) error {
+	for {
+		l.mu.Lock()
+		var now = time.Now()
+		l.requests.refill(now)
+		l.tokens.refill(now)
+		var delay = l.requests.delay(1)
+		if d := l.tokens.delay(float64(tokens)); d > delay {
+			delay = d
+		}
+		if delay == 0 {
+			l.requests.take(1)
+			l.tokens.take(float64(tokens))
+			l.mu.Unlock()
+			return nil
+		}
+		l.mu.Unlock()
+
+		var timer = time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// bucket is a token bucket holding up to capacity tokens, which is refilled
+// at a constant rate so that it goes from empty to full in a minute.
+type bucket struct {
+	capacity float64
+	level    float64
+	last     time.Time
+}
+
+func newBucket(perMinute int, now time.Time) bucket {
+	return bucket{
+		capacity: float64(perMinute),
+		level:    float64(perMinute),
+		last:     now,
+	}
+}
+
+func (b *bucket) refill(now time.Time) {
+	if b.capacity == 0 {
+		return
+	}
+	b.level += now.Sub(b.last).Minutes() * b.capacity
+	if b.level > b.capacity {
+		b.level = b.capacity
+	}
+	b.last = now
+}
+
+// delay returns how long to wait until n tokens are available, or zero if
+// they are available right now.
+func (b *bucket) delay(n float64) time.Duration {
+	if b.capacity == 0 {
+		return 0
+	}
+	if n > b.capacity {
+		n = b.capacity
+	}
+	if b.level >= n {
+		return 0
+	}
+	var d = time.Duration((n - b.level) / b.capacity * float64(time.Minute))
+	if d < time.Millisecond {
+		d = time.Millisecond
+	}
+	return d
+}
+
+func (b *bucket) take(n float64) {
+	if b.capacity == 0 {
+		return
+	}
+	if n > b.capacity {
+		n = b.capacity
+	}
+	b.level -= n
+}
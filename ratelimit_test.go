@@ -0,0 +1,67 @@
+package gptease_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Volumental/gptease"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var l = gptease.NewRateLimiter(2, 100)
+
+	// The buckets start out full, so a burst within the limits is allowed.
+	for i := 0; i < 2; i++ {
+		if err := l.Wait(context.Background(), 10); err != nil {
+			t.Fatalf("Wait() = %v, want nil", err)
+		}
+	}
+
+	// The request bucket is now empty and takes ~30s to refill.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx, 10); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait() = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// Token cost is checked as well, even when requests are unlimited.
+	l = gptease.NewRateLimiter(0, 100)
+	if err := l.Wait(context.Background(), 90); err != nil {
+		t.Fatalf("Wait() = %v, want nil", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx, 50); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait() = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestToolRateLimiter(t *testing.T) {
+	newFakeAPI(t,
+		`{"choices": [{"message": {"role": "assistant", "tool_calls": [
+			{"id": "call_1", "type": "function", "function": {"name": "lookup", "arguments": "{}"}}
+		]}, "finish_reason": "tool_calls"}]}`,
+		`{"choices": [{"message": {"role": "assistant", "content": "Done"}, "finish_reason": "stop"}]}`,
+	)
+	var l = gptease.NewRateLimiter(1, 0)
+	var chat = gptease.Chat{
+		Tools: []gptease.Tool{{
+			Name:        "lookup",
+			Parameters:  `{"type": "object"}`,
+			Handler:     func(string) (string, error) { return "found", nil },
+			RateLimiter: l,
+		}},
+	}
+	if _, err := chat.Exchange("Look it up"); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+
+	// The call to the tool used up the capacity.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx, 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait() = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
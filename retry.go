@@ -0,0 +1,116 @@
+package gptease
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// RetryPolicy controls how requests to the API are retried when they fail
+// for reasons that are likely to pass, such as rate limits and overloaded
+// servers. The zero value means no retries.
+type RetryPolicy struct {
+	// MaxRetries is the number of times to retry a failed request.
+	MaxRetries int
+	// BaseDelay is the delay before the first retry, which is doubled for
+	// each following retry. The actual delay is randomly shortened by up to
+	// half, so that clients failing at the same time don't retry at the
+	// same time. Defaults to one second.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between retries. Defaults to 30 seconds.
+	MaxDelay time.Duration
+	// Retryable decides which errors are worth retrying. It defaults to
+	// IsRetryable, which it can fall back on, for example to retry errors
+	// returned by an Interceptor as well, or to not retry rate limits. Errors
+	// matching ErrModelOverloaded can be left unretried, to fall back on
+	// another model instead.
+	Retryable func(err error) bool
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+// delay returns how long to wait before the given retry, counting from 0.
+func (p RetryPolicy) delay(retry int) time.Duration {
+	var d, max = p.BaseDelay, p.MaxDelay
+	if d <= 0 {
+		d = time.Second
+	}
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+	for i := 0; i < retry && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// IsRetryable tells whether a request that failed with err is worth
+// retrying. That is the case for rate limits and server errors, but not for
+// errors in the request itself, such as 400 Bad Request or 401 Unauthorized.
+func IsRetryable(err error) bool {
+	var status int
+	var apiErr *openai.APIError
+	var reqErr *openai.RequestError
+	switch {
+	case errors.As(err, &apiErr):
+		status = apiErr.HTTPStatusCode
+	case errors.As(err, &reqErr):
+		status = reqErr.HTTPStatusCode
+	default:
+		return false
+	}
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// overloadedError is an error from the API saying that the model is
+// overloaded. It matches ErrModelOverloaded, while still unwrapping to the
+// error from go-openai.
+type overloadedError struct {
+	err error
+}
+
+func (e overloadedError) Error() string        { return e.err.Error() }
+func (e overloadedError) Unwrap() error        { return e.err }
+func (e overloadedError) Is(target error) bool { return target == ErrModelOverloaded }
+
+// classifyError makes errors from the API saying that the model is
+// overloaded match ErrModelOverloaded, so that callers can react to it, such
+// as by switching to another model. The API reports this as 503 Service
+// Unavailable.
+func classifyError(err error) error {
+	var apiErr *openai.APIError
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	if apiErr.HTTPStatusCode == http.StatusServiceUnavailable ||
+		strings.Contains(apiErr.Type, "overloaded") ||
+		strings.Contains(strings.ToLower(apiErr.Message), "overloaded") {
+		return overloadedError{err}
+	}
+	return err
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	var t = time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
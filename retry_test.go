@@ -0,0 +1,121 @@
+package gptease_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Volumental/gptease"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// newFlakyAPI serves the given status codes in order, with an error for
+// anything but 200, and a response once they run out.
+func newFlakyAPI(t *testing.T, statuses ...int) *int {
+	var requests int
+	var srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if len(statuses) > 0 && statuses[0] != http.StatusOK {
+			var status = statuses[0]
+			statuses = statuses[1:]
+			http.Error(w, `{"error": {"message": "failed"}}`, status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"choices": [{"message": {"role": "assistant", "content": "Hi."}, "finish_reason": "stop"}]}`)
+	}))
+	t.Cleanup(srv.Close)
+	var config = openai.DefaultConfig("test")
+	config.BaseURL = srv.URL + "/v1"
+	gptease.SetDefaultClient(gptease.NewClientWithConfig(config))
+	return &requests
+}
+
+func TestRetryPolicy(t *testing.T) {
+	var policy = gptease.RetryPolicy{MaxRetries: 2, BaseDelay: time.Millisecond}
+
+	var requests = newFlakyAPI(t, http.StatusTooManyRequests, http.StatusServiceUnavailable)
+	var chat = gptease.Chat{RetryPolicy: policy}
+	if _, err := chat.Exchange("Hello"); err != nil {
+		t.Errorf("Exchange() error = %v", err)
+	}
+	// The retries don't add to the dialogue.
+	if *requests != 3 || len(chat.Dialogue) != 2 {
+		t.Errorf("%d requests and %d messages, want 3 and 2", *requests, len(chat.Dialogue))
+	}
+
+	requests = newFlakyAPI(t, 500, 500, 500)
+	chat = gptease.Chat{RetryPolicy: policy}
+	if _, err := chat.Exchange("Hello"); err == nil || *requests != 3 {
+		t.Errorf("Exchange() error = %v after %d requests, want an error after 3", err, *requests)
+	}
+
+	requests = newFlakyAPI(t, http.StatusBadRequest)
+	chat = gptease.Chat{RetryPolicy: policy}
+	if _, err := chat.Exchange("Hello"); err == nil || *requests != 1 {
+		t.Errorf("Exchange() error = %v after %d requests, want an error without retries", err, *requests)
+	}
+
+	requests = newFlakyAPI(t, http.StatusServiceUnavailable)
+	chat = gptease.Chat{}
+	if _, err := chat.Exchange("Hello"); err == nil || *requests != 1 {
+		t.Errorf("Exchange() error = %v after %d requests, want no retries by default", err, *requests)
+	}
+}
+
+func TestRetryPolicyRetryable(t *testing.T) {
+	var requests = newFlakyAPI(t, http.StatusTooManyRequests, http.StatusBadRequest)
+	var chat = gptease.Chat{RetryPolicy: gptease.RetryPolicy{
+		MaxRetries: 3,
+		BaseDelay:  time.Millisecond,
+		// Retry bad requests, but not rate limits.
+		Retryable: func(err error) bool {
+			var apiErr *openai.APIError
+			return errors.As(err, &apiErr) && apiErr.HTTPStatusCode == http.StatusBadRequest
+		},
+	}}
+	if _, err := chat.Exchange("Hello"); err == nil || *requests != 1 {
+		t.Errorf("Exchange() error = %v after %d requests, want an error without retries", err, *requests)
+	}
+	if _, err := chat.Exchange("Hello"); err != nil || *requests != 3 {
+		t.Errorf("Exchange() error = %v after %d requests, want success after 3", err, *requests)
+	}
+}
+
+func TestModelOverloaded(t *testing.T) {
+	newFlakyAPI(t, http.StatusServiceUnavailable, http.StatusInternalServerError)
+	var chat gptease.Chat
+	_, err := chat.Exchange("Hello")
+	if !errors.Is(err, gptease.ErrModelOverloaded) {
+		t.Errorf("Exchange() error = %v, want %v", err, gptease.ErrModelOverloaded)
+	}
+	var apiErr *openai.APIError
+	if !errors.As(err, &apiErr) || apiErr.HTTPStatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Exchange() error = %v, want the API error", err)
+	}
+	if _, err := chat.Exchange("Hello"); err == nil || errors.Is(err, gptease.ErrModelOverloaded) {
+		t.Errorf("Exchange() error = %v, want another error", err)
+	}
+}
+
+func TestRetryRateLimited(t *testing.T) {
+	var requests = newFlakyAPI(t, http.StatusServiceUnavailable)
+	// Only one request a minute, so the retry has to wait for longer than
+	// the context allows.
+	var chat = gptease.Chat{
+		RetryPolicy: gptease.RetryPolicy{MaxRetries: 1, BaseDelay: time.Millisecond},
+		RateLimiter: gptease.NewRateLimiter(1, 0),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := chat.ExchangeContext(ctx, "Hello"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ExchangeContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if *requests != 1 {
+		t.Errorf("made %d requests, want 1", *requests)
+	}
+}
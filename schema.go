@@ -0,0 +1,515 @@
+package gptease
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// SchemaErrors is a list of problems found in a JSON Schema.
+type SchemaErrors []error
+
+func (e SchemaErrors) Error() string {
+	var msgs = make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+var schemaTypes = map[string]bool{
+	"object": true, "array": true, "string": true, "integer": true,
+	"number": true, "boolean": true, "null": true,
+}
+
+// ValidateSchema checks that the Parameters of the tool is a structurally
+// valid JSON Schema, such as only using known types and only requiring
+// properties that exist. If not, it returns SchemaErrors describing all
+// problems found.
+//
+// It's a safety net for catching mistakes in hand-written schemas, or in the
+// ones generated by MakeTool, before the API rejects them.
+func (t *Tool) ValidateSchema() error {
+	var schema any
+	if err := json.Unmarshal([]byte(t.Parameters), &schema); err != nil {
+		return SchemaErrors{fmt.Errorf("parameters: %w", err)}
+	}
+	var errs SchemaErrors
+	validateSchema("parameters", schema, &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateSchema(path string, schema any, errs *SchemaErrors) {
+	var fail = func(format string, args ...any) {
+		*errs = append(*errs, fmt.Errorf("%s: "+format, append([]any{path}, args...)...))
+	}
+	s, ok := schema.(map[string]any)
+	if !ok {
+		fail("schema is not an object")
+		return
+	}
+
+	var types = map[string]bool{}
+	switch t := s["type"].(type) {
+	case nil:
+	case string:
+		types[t] = true
+	case []any:
+		for _, tt := range t {
+			if ts, ok := tt.(string); ok {
+				types[ts] = true
+			} else {
+				fail("type %v is not a string", tt)
+			}
+		}
+	default:
+		fail("type is neither a string nor a list")
+	}
+	for t := range types {
+		if !schemaTypes[t] {
+			fail("unknown type %q", t)
+		}
+	}
+
+	if d, ok := s["description"]; ok {
+		if _, ok := d.(string); !ok {
+			fail("description is not a string")
+		}
+	}
+
+	var props map[string]any
+	if p, ok := s["properties"]; ok {
+		if props, ok = p.(map[string]any); !ok {
+			fail("properties is not an object")
+		}
+		var names []string
+		for name := range props {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			validateSchema(path+"."+name, props[name], errs)
+		}
+	}
+	if (props != nil || s["additionalProperties"] != nil) && len(types) > 0 && !types["object"] {
+		fail("properties given for non-object type")
+	}
+	switch ap := s["additionalProperties"].(type) {
+	case nil, bool:
+	case map[string]any:
+		validateSchema(path+".*", ap, errs)
+	default:
+		fail("additionalProperties is neither a boolean nor a schema")
+	}
+
+	if r, ok := s["required"]; ok {
+		req, ok := r.([]any)
+		if !ok {
+			fail("required is not a list")
+		}
+		for _, name := range req {
+			if n, ok := name.(string); !ok {
+				fail("required property %v is not a string", name)
+			} else if _, ok := props[n]; !ok {
+				fail("required property %q does not exist", n)
+			}
+		}
+	}
+
+	if d, ok := s["dependentRequired"]; ok {
+		deps, ok := d.(map[string]any)
+		if !ok {
+			fail("dependentRequired is not an object")
+		}
+		var names []string
+		for name := range deps {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if _, ok := props[name]; !ok {
+				fail("dependentRequired property %q does not exist", name)
+			}
+			req, ok := deps[name].([]any)
+			if !ok {
+				fail("dependentRequired of %q is not a list", name)
+			}
+			for _, r := range req {
+				if n, ok := r.(string); !ok {
+					fail("property %v required by %q is not a string", r, name)
+				} else if _, ok := props[n]; !ok {
+					fail("property %q required by %q does not exist", n, name)
+				}
+			}
+		}
+	}
+
+	if items, ok := s["items"]; ok {
+		if len(types) > 0 && !types["array"] {
+			fail("items given for non-array type")
+		}
+		validateSchema(path+"[]", items, errs)
+	} else if types["array"] {
+		fail("array type without items")
+	}
+
+	if e, ok := s["enum"]; ok {
+		values, ok := e.([]any)
+		if !ok || len(values) == 0 {
+			fail("enum is not a non-empty list")
+		}
+		for _, v := range values {
+			if len(types) > 0 && !types[jsonType(v)] && !(jsonType(v) == "number" && types["integer"] && isInteger(v)) {
+				fail("enum value %v does not match type", v)
+			}
+		}
+	}
+}
+
+// jsonType returns the JSON Schema type of a decoded JSON value. Numbers are
+// always reported as "number", even if they happen to be integers.
+func jsonType(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func isInteger(v any) bool {
+	f, ok := v.(float64)
+	return ok && f == math.Trunc(f)
+}
+
+// CheckToolRoundTrip checks that a tool made with MakeTool can receive the
+// sample value as arguments. The sample is marshaled to JSON like the AI
+// would send it, which must be valid according to the Parameters of the tool,
+// and then decoded like the Handler would, which must give back the same
+// value. The handler itself isn't called.
+//
+// It's meant to be used in tests, to catch mismatches between the generated
+// schema and the actual JSON encoding of complex argument types, such as
+// those with custom MarshalJSON methods:
+//
+//	if err := gptease.CheckToolRoundTrip(tool, Args{...}); err != nil {
+//		t.Error(err)
+//	}
+func CheckToolRoundTrip(tool Tool, sample any) error {
+	var schema any
+	if err := json.Unmarshal([]byte(tool.Parameters), &schema); err != nil {
+		return fmt.Errorf("parameters: %w", err)
+	}
+	b, err := json.Marshal(sample)
+	if err != nil {
+		return fmt.Errorf("marshal sample: %w", err)
+	}
+	var arguments any
+	if err := json.Unmarshal(b, &arguments); err != nil {
+		return fmt.Errorf("unmarshal sample: %w", err)
+	}
+	var errs SchemaErrors
+	validateValue("arguments", schema, arguments, &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+
+	// Decode the same way as the handlers made by MakeTool.
+	var v = reflect.New(reflect.TypeOf(sample))
+	var dec = json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(v.Interface()); err != nil {
+		return fmt.Errorf("decode arguments: %w", err)
+	}
+	// Compare the JSON encodings, rather than the values, since numbers in
+	// interfaces are decoded as json.Number.
+	b2, err := json.Marshal(v.Elem().Interface())
+	if err != nil {
+		return fmt.Errorf("marshal decoded arguments: %w", err)
+	}
+	var again any
+	if err := json.Unmarshal(b2, &again); err != nil {
+		return fmt.Errorf("unmarshal decoded arguments: %w", err)
+	}
+	if !reflect.DeepEqual(arguments, again) {
+		return fmt.Errorf("arguments changed when decoded: %s became %s", b, b2)
+	}
+	return nil
+}
+
+// validateValue checks that a decoded JSON value is valid according to a
+// schema. Only the parts of JSON Schema used by MakeTool are supported.
+func validateValue(path string, schema, v any, errs *SchemaErrors) {
+	validateValueOf(path, schema, v, false, errs)
+}
+
+// validatePartialValue is like validateValue, but for a value decoded from
+// JSON that was cut off and then repaired. Required properties may not have
+// been generated yet, the last string may be incomplete, and nulls may stand
+// in for values not generated yet.
+func validatePartialValue(path string, schema, v any, errs *SchemaErrors) {
+	validateValueOf(path, schema, v, true, errs)
+}
+
+func validateValueOf(path string, schema, v any, partial bool, errs *SchemaErrors) {
+	if partial && v == nil {
+		return
+	}
+	var fail = func(format string, args ...any) {
+		*errs = append(*errs, fmt.Errorf("%s: "+format, append([]any{path}, args...)...))
+	}
+	s, ok := schema.(map[string]any)
+	if !ok {
+		return
+	}
+
+	var types []string
+	switch t := s["type"].(type) {
+	case string:
+		types = []string{t}
+	case []any:
+		for _, x := range t {
+			if x, ok := x.(string); ok {
+				types = append(types, x)
+			}
+		}
+	}
+	if len(types) > 0 {
+		var matched bool
+		for _, t := range types {
+			if t == jsonType(v) || t == "integer" && isInteger(v) {
+				matched = true
+			}
+		}
+		if !matched {
+			fail("%s is not of type %s", jsonType(v), strings.Join(types, " or "))
+			return
+		}
+	}
+
+	if enum, ok := s["enum"].([]any); ok {
+		var found bool
+		for _, e := range enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+			}
+			if e, ok := e.(string); ok && partial {
+				if v, ok := v.(string); ok && strings.HasPrefix(e, v) {
+					found = true
+				}
+			}
+		}
+		if !found {
+			fail("%v is not one of %v", v, enum)
+		}
+	}
+
+	switch v := v.(type) {
+	case map[string]any:
+		var props, _ = s["properties"].(map[string]any)
+		if req, ok := s["required"].([]any); ok && !partial {
+			for _, r := range req {
+				if r, ok := r.(string); ok {
+					if _, ok := v[r]; !ok {
+						fail("missing required property %q", r)
+					}
+				}
+			}
+		}
+		if deps, ok := s["dependentRequired"].(map[string]any); ok && !partial {
+			for name, req := range deps {
+				if _, ok := v[name]; !ok {
+					continue
+				}
+				req, _ := req.([]any)
+				for _, r := range req {
+					if r, ok := r.(string); ok {
+						if _, ok := v[r]; !ok {
+							fail("property %q is required when %q is present", r, name)
+						}
+					}
+				}
+			}
+		}
+		var keys = make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if p, ok := props[k]; ok {
+				validateValueOf(path+"."+k, p, v[k], partial, errs)
+			} else if ap, ok := s["additionalProperties"].(map[string]any); ok {
+				validateValueOf(path+"."+k, ap, v[k], partial, errs)
+			} else if props != nil && s["additionalProperties"] == false {
+				fail("unexpected property %q", k)
+			}
+		}
+	case []any:
+		for i, x := range v {
+			validateValueOf(fmt.Sprintf("%s[%d]", path, i), s["items"], x, partial, errs)
+		}
+	}
+}
+
+var toolNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// Limits on the schemas of tools imposed by the API.
+const (
+	maxSchemaDepth      = 10
+	maxSchemaProperties = 5000
+)
+
+// ValidateTools checks that the Tools of the chat will be accepted by the
+// API, without making any requests. Aside from the checks made by
+// Tool.ValidateSchema, it checks that tool names are valid and unique, that
+// the parameters are objects, that the schemas are within the limits on
+// nesting and number of properties, and that they don't use keywords that
+// the API doesn't support in strict mode, such as "pattern", "minLength" or
+// "dependentRequired", which the AI can't be relied on to respect. If not,
+// it returns SchemaErrors describing all problems found.
+//
+// It's meant to be called at startup, to catch problems before the first
+// request rather than under load.
+func (c *Chat) ValidateTools() error {
+	var errs SchemaErrors
+	var seen = map[string]bool{}
+	for _, t := range c.Tools {
+		var fail = func(format string, args ...any) {
+			errs = append(errs, fmt.Errorf("tool %q: "+format, append([]any{t.Name}, args...)...))
+		}
+		if !toolNamePattern.MatchString(t.Name) {
+			fail("name must be 1 to 64 letters, digits, underscores or dashes")
+		}
+		if seen[t.Name] {
+			fail("name is used by another tool")
+		}
+		seen[t.Name] = true
+		if t.Handler == nil {
+			fail("no handler")
+		}
+
+		if err := t.ValidateSchema(); err != nil {
+			var serrs SchemaErrors
+			if errors.As(err, &serrs) {
+				for _, e := range serrs {
+					fail("%v", e)
+				}
+			} else {
+				fail("%v", err)
+			}
+			continue
+		}
+		var schema map[string]any
+		if err := json.Unmarshal([]byte(t.Parameters), &schema); err != nil {
+			fail("parameters are not an object")
+			continue
+		}
+		if schema["type"] != "object" {
+			fail("parameters must be of type object")
+		}
+		var depth, properties = schemaSize(schema)
+		if depth > maxSchemaDepth {
+			fail("parameters are nested %d levels deep, more than the limit of %d", depth, maxSchemaDepth)
+		}
+		if properties > maxSchemaProperties {
+			fail("parameters have %d properties, more than the limit of %d", properties, maxSchemaProperties)
+		}
+		checkStrictKeywords("parameters", schema, func(path, keyword string) {
+			fail("%s: %s is not supported in strict mode", path, keyword)
+		})
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// strictUnsupported are the keywords that the API doesn't support in strict
+// mode.
+var strictUnsupported = []string{
+	"contains", "dependentRequired", "dependentSchemas", "else", "format",
+	"if", "maxContains", "maxItems", "maxLength", "maxProperties", "maximum",
+	"minContains", "minItems", "minLength", "minProperties", "minimum",
+	"multipleOf", "not", "pattern", "patternProperties", "propertyNames",
+	"then", "unevaluatedItems", "unevaluatedProperties", "uniqueItems",
+}
+
+// checkStrictKeywords calls fail for each keyword in a schema, or the
+// schemas nested in it, that isn't supported in strict mode.
+func checkStrictKeywords(path string, schema any, fail func(path, keyword string)) {
+	s, ok := schema.(map[string]any)
+	if !ok {
+		return
+	}
+	for _, k := range strictUnsupported {
+		if _, ok := s[k]; ok {
+			fail(path, k)
+		}
+	}
+	if props, ok := s["properties"].(map[string]any); ok {
+		var names = make([]string, 0, len(props))
+		for name := range props {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			checkStrictKeywords(path+"."+name, props[name], fail)
+		}
+	}
+	checkStrictKeywords(path+"[]", s["items"], fail)
+	checkStrictKeywords(path+".*", s["additionalProperties"], fail)
+	for _, k := range []string{"anyOf", "allOf", "oneOf"} {
+		if subs, ok := s[k].([]any); ok {
+			for i, sub := range subs {
+				checkStrictKeywords(fmt.Sprintf("%s.%s[%d]", path, k, i), sub, fail)
+			}
+		}
+	}
+}
+
+// schemaSize returns the nesting depth of objects in a schema, and the total
+// number of properties in it.
+func schemaSize(schema any) (depth, properties int) {
+	s, ok := schema.(map[string]any)
+	if !ok {
+		return 0, 0
+	}
+	var inner int
+	var visit = func(sub any) {
+		d, p := schemaSize(sub)
+		if d > inner {
+			inner = d
+		}
+		properties += p
+	}
+	if props, ok := s["properties"].(map[string]any); ok {
+		properties += len(props)
+		for _, p := range props {
+			visit(p)
+		}
+	}
+	visit(s["items"])
+	visit(s["additionalProperties"])
+	if s["type"] == "object" || s["properties"] != nil {
+		return inner + 1, properties
+	}
+	return inner, properties
+}
@@ -0,0 +1,131 @@
+package gptease
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// SessionEventKind tells what a SessionEvent is about.
+type SessionEventKind string
+
+const (
+	SessionRequest  SessionEventKind = "request"
+	SessionResponse SessionEventKind = "response"
+	SessionToolCall SessionEventKind = "tool_call"
+)
+
+// SessionEvent is something that happened during a recorded session. Which
+// fields are set depends on the kind of event:
+//
+//   - SessionRequest: Request, the complete request sent to the API.
+//   - SessionResponse: Response, or Error if the request failed.
+//   - SessionToolCall: ToolCall and its Result, or Error if the call failed.
+type SessionEvent struct {
+	Time     time.Time                      `json:"time"`
+	Kind     SessionEventKind               `json:"kind"`
+	Request  *openai.ChatCompletionRequest  `json:"request,omitempty"`
+	Response *openai.ChatCompletionResponse `json:"response,omitempty"`
+	ToolCall *openai.ToolCall               `json:"tool_call,omitempty"`
+	Result   string                         `json:"result,omitempty"`
+	Error    string                         `json:"error,omitempty"`
+}
+
+// SessionRecorder records everything that happens in one or more Chats, to
+// help debugging why an agent took a particular path. Set it as the Recorder
+// of the chats to record, and use Save to store the session for viewing or
+// stepping through later, after loading it with LoadSession. A
+// SessionRecorder is safe for concurrent use.
+type SessionRecorder struct {
+	// CanonicalArguments makes the arguments of tool calls be recorded in
+	// canonical form, see CanonicalJSON, wherever they appear, so that
+	// recorded sessions can be compared in snapshot tests regardless of the
+	// order of the keys generated by the AI. The Time of events still
+	// varies, so leave it out when comparing.
+	CanonicalArguments bool
+
+	mu     sync.Mutex
+	events []SessionEvent
+}
+
+func (r *SessionRecorder) record(ev SessionEvent) {
+	ev.Time = time.Now()
+	if r.CanonicalArguments {
+		if ev.ToolCall != nil {
+			var call = *ev.ToolCall
+			call.Function.Arguments = CanonicalJSON(call.Function.Arguments)
+			ev.ToolCall = &call
+		}
+		// Copy what's modified, as requests and responses are still in use.
+		if ev.Request != nil {
+			var req = *ev.Request
+			req.Messages = append([]openai.ChatCompletionMessage(nil), req.Messages...)
+			for i := range req.Messages {
+				req.Messages[i].ToolCalls = canonicalCalls(req.Messages[i].ToolCalls)
+			}
+			ev.Request = &req
+		}
+		if ev.Response != nil {
+			var resp = *ev.Response
+			resp.Choices = append([]openai.ChatCompletionChoice(nil), resp.Choices...)
+			for i := range resp.Choices {
+				resp.Choices[i].Message.ToolCalls = canonicalCalls(resp.Choices[i].Message.ToolCalls)
+			}
+			ev.Response = &resp
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, ev)
+}
+
+// canonicalCalls returns a copy of the tool calls with their arguments in
+// canonical form.
+func canonicalCalls(calls []openai.ToolCall) []openai.ToolCall {
+	if len(calls) == 0 {
+		return calls
+	}
+	calls = append([]openai.ToolCall(nil), calls...)
+	for i := range calls {
+		calls[i].Function.Arguments = CanonicalJSON(calls[i].Function.Arguments)
+	}
+	return calls
+}
+
+// Events returns the events recorded so far, in order.
+func (r *SessionRecorder) Events() []SessionEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]SessionEvent(nil), r.events...)
+}
+
+// Save writes the events recorded so far to w, as JSON with one event per
+// line.
+func (r *SessionRecorder) Save(w io.Writer) error {
+	var enc = json.NewEncoder(w)
+	for _, ev := range r.Events() {
+		if err := enc.Encode(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadSession reads events saved by SessionRecorder.Save.
+func LoadSession(r io.Reader) ([]SessionEvent, error) {
+	var events []SessionEvent
+	var dec = json.NewDecoder(bufio.NewReader(r))
+	for {
+		var ev SessionEvent
+		if err := dec.Decode(&ev); err == io.EOF {
+			return events, nil
+		} else if err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+}
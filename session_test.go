@@ -0,0 +1,99 @@
+package gptease_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Volumental/gptease"
+)
+
+func TestSessionRecorder(t *testing.T) {
+	newFakeAPI(t,
+		`{"choices": [{"message": {"role": "assistant", "tool_calls": [
+			{"id": "call_1", "type": "function", "function": {"name": "time", "arguments": "{}"}}
+		]}, "finish_reason": "tool_calls"}]}`,
+		`{"choices": [{"message": {"role": "assistant", "content": "Noon."}, "finish_reason": "stop"}]}`,
+	)
+	var rec gptease.SessionRecorder
+	var chat = gptease.Chat{
+		Tools: []gptease.Tool{{
+			Name:       "time",
+			Parameters: `{"type": "object"}`,
+			Handler:    func(string) (string, error) { return "12:00", nil },
+		}},
+		Recorder: &rec,
+	}
+	if _, err := chat.Exchange("What time is it?"); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := rec.Save(&buf); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	events, err := gptease.LoadSession(&buf)
+	if err != nil {
+		t.Fatalf("LoadSession() error = %v", err)
+	}
+	var kinds []gptease.SessionEventKind
+	for _, ev := range events {
+		kinds = append(kinds, ev.Kind)
+	}
+	var want = []gptease.SessionEventKind{
+		gptease.SessionRequest, gptease.SessionResponse, gptease.SessionToolCall,
+		gptease.SessionRequest, gptease.SessionResponse,
+	}
+	if len(kinds) != len(want) {
+		t.Fatalf("kinds = %v, want %v", kinds, want)
+	}
+	for i := range want {
+		if kinds[i] != want[i] {
+			t.Errorf("kinds = %v, want %v", kinds, want)
+		}
+	}
+	if events[2].Result != "12:00" || events[2].ToolCall.ID != "call_1" {
+		t.Errorf("tool call event = %+v", events[2])
+	}
+	if len(events[3].Request.Messages) != 3 || events[4].Response.Choices[0].Message.Content != "Noon." {
+		t.Errorf("second request and response = %+v, %+v", events[3].Request, events[4].Response)
+	}
+}
+
+func TestSessionRecorderCanonicalArguments(t *testing.T) {
+	newFakeAPI(t,
+		`{"choices": [{"message": {"role": "assistant", "tool_calls": [
+			{"id": "call_1", "type": "function", "function": {"name": "echo", "arguments": "{\"b\": 2, \"a\": 1}"}}
+		]}, "finish_reason": "tool_calls"}]}`,
+		`{"choices": [{"message": {"role": "assistant", "content": "Done."}, "finish_reason": "stop"}]}`,
+	)
+	var rec = gptease.SessionRecorder{CanonicalArguments: true}
+	var chat = gptease.Chat{
+		Tools: []gptease.Tool{{
+			Name:       "echo",
+			Parameters: `{"type": "object"}`,
+			Handler:    func(input string) (string, error) { return input, nil },
+		}},
+		Recorder: &rec,
+	}
+	if _, err := chat.Exchange("Echo."); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	var events = rec.Events()
+	var want = "{\n  \"a\": 1,\n  \"b\": 2\n}"
+	if got := events[1].Response.Choices[0].Message.ToolCalls[0].Function.Arguments; got != want {
+		t.Errorf("recorded response arguments = %q, want %q", got, want)
+	}
+	if got := events[2].ToolCall.Function.Arguments; got != want {
+		t.Errorf("recorded tool call arguments = %q, want %q", got, want)
+	}
+	if got := events[3].Request.Messages[1].ToolCalls[0].Function.Arguments; got != want {
+		t.Errorf("recorded request arguments = %q, want %q", got, want)
+	}
+	if got := chat.Dialogue[1].ToolCalls[0].Function.Arguments; got != `{"b": 2, "a": 1}` {
+		t.Errorf("arguments in dialogue = %q, want them unchanged", got)
+	}
+	// The tool itself gets the arguments as generated.
+	if got := events[2].Result; got != `{"b": 2, "a": 1}` {
+		t.Errorf("tool result = %q, want the original arguments", got)
+	}
+}
@@ -0,0 +1,201 @@
+package gptease
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+var (
+	streamSlotsMu sync.Mutex
+	streamSlots   chan struct{}
+)
+
+// SetMaxConcurrentStreams limits the number of streamed responses, such as
+// by TalkStream, that may be open at the same time. Once the limit is
+// reached, starting another stream blocks until one of them is done. This
+// keeps a server with many simultaneous users from exhausting connections. A
+// limit of zero, the default, means no limit.
+//
+// Streams already open when the limit is changed are not counted towards
+// the new limit.
+func SetMaxConcurrentStreams(n int) {
+	streamSlotsMu.Lock()
+	defer streamSlotsMu.Unlock()
+	if n <= 0 {
+		streamSlots = nil
+	} else {
+		streamSlots = make(chan struct{}, n)
+	}
+}
+
+// acquireStream waits for a stream to be allowed to open, and returns a
+// function to call when it's closed.
+func acquireStream(ctx context.Context) (release func(), err error) {
+	streamSlotsMu.Lock()
+	var slots = streamSlots
+	streamSlotsMu.Unlock()
+	if slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// TalkStream is like Talk, but the response is streamed, calling onDelta with
+// each piece of text as soon as it's generated. The full response is still
+// returned and added to the dialogue once done.
+//
+// Text that the AI provides along with a request to call tools, such as "Let
+// me check the weather.", is streamed too, before the tools are invoked. So
+// in a conversation using tools, onDelta may be called for several responses
+// in turn, with the tools running in between. Use OnNarration to tell these
+// apart from the final response.
+//
+// The API doesn't report token usage for streamed responses, so they don't
+// count towards MaxConversationTokens. Refusals aren't detected either, and
+// are streamed like any other response.
+func (c *Chat) TalkStream(onDelta func(delta string)) (response string, err error) {
+	defer c.watchDialogue()()
+	var opts = c.options()
+	opts.onDelta = onDelta
+	return c.talk(&opts)
+}
+
+// ExchangeStream is like Exchange, but the response is streamed, see
+// TalkStream.
+func (c *Chat) ExchangeStream(content string, onDelta func(delta string)) (response string, err error) {
+	defer c.watchDialogue()()
+	var opts = c.options()
+	opts.onDelta = onDelta
+	return c.exchange(content, &opts)
+}
+
+// StreamSSE is like ExchangeStream, but writes the response to w as
+// server-sent events, the usual way of streaming to a web browser. Each
+// piece of the response is sent as a "data" event as soon as it's generated,
+// and once done, an event with the data "[DONE]" is sent. If the exchange
+// fails after the response has started, an "error" event with the error
+// message is sent before the error is returned.
+//
+// The headers of the response are set, so nothing must have been written to
+// w before.
+func (c *Chat) StreamSSE(w http.ResponseWriter, content string) error {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	var flusher, _ = w.(http.Flusher)
+	var send = func(event, data string) {
+		var b strings.Builder
+		if event != "" {
+			b.WriteString("event: " + event + "\n")
+		}
+		// Line breaks in the data are sent as separate data lines, which
+		// the client joins with line breaks again.
+		for _, line := range strings.Split(data, "\n") {
+			b.WriteString("data: " + line + "\n")
+		}
+		b.WriteString("\n")
+		_, _ = io.WriteString(w, b.String())
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if _, err := c.ExchangeStream(content, func(delta string) { send("", delta) }); err != nil {
+		send("error", err.Error())
+		return err
+	}
+	send("", "[DONE]")
+	return nil
+}
+
+// completeStream makes a streamed chat completion request, calling onDelta
+// with the content as it arrives, and assembles the chunks into a complete
+// response.
+//
+// If check is given, it's called with the content so far after each piece,
+// and if it returns an error, the stream is aborted and the error returned.
+func completeStream(ctx context.Context, client *openai.Client, req openai.ChatCompletionRequest, onDelta func(string), check func(string) error) (openai.ChatCompletionResponse, error) {
+	var resp openai.ChatCompletionResponse
+	release, err := acquireStream(ctx)
+	if err != nil {
+		return resp, err
+	}
+	defer release()
+	stream, err := client.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+	defer stream.Close()
+
+	var msg = openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant}
+	var content strings.Builder
+	var finishReason openai.FinishReason
+	var received bool
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return resp, err
+		}
+		resp.ID, resp.Object, resp.Created, resp.Model = chunk.ID, "chat.completion", chunk.Created, chunk.Model
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		received = true
+		var choice = chunk.Choices[0]
+		if choice.Delta.Content != "" {
+			content.WriteString(choice.Delta.Content)
+			onDelta(choice.Delta.Content)
+			if check != nil {
+				if err := check(content.String()); err != nil {
+					return resp, err
+				}
+			}
+		}
+		for _, d := range choice.Delta.ToolCalls {
+			// Tool calls arrive in pieces, identified by their index.
+			var i = len(msg.ToolCalls) - 1
+			if d.Index != nil {
+				i = *d.Index
+			}
+			if i < 0 {
+				i = 0
+			}
+			for len(msg.ToolCalls) <= i {
+				msg.ToolCalls = append(msg.ToolCalls, openai.ToolCall{})
+			}
+			var call = &msg.ToolCalls[i]
+			if d.ID != "" {
+				call.ID = d.ID
+			}
+			if d.Type != "" {
+				call.Type = d.Type
+			}
+			call.Function.Name += d.Function.Name
+			call.Function.Arguments += d.Function.Arguments
+		}
+		if choice.FinishReason != "" {
+			finishReason = choice.FinishReason
+		}
+	}
+	if !received {
+		return resp, nil
+	}
+	msg.Content = content.String()
+	resp.Choices = []openai.ChatCompletionChoice{{
+		Message:      msg,
+		FinishReason: finishReason,
+	}}
+	return resp, nil
+}
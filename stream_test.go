@@ -0,0 +1,126 @@
+package gptease_test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Volumental/gptease"
+)
+
+// sse formats chunks as a stream of server-sent events.
+func sse(chunks ...string) string {
+	var b strings.Builder
+	for _, c := range chunks {
+		b.WriteString("data: " + c + "\n\n")
+	}
+	b.WriteString("data: [DONE]\n\n")
+	return b.String()
+}
+
+func TestExchangeStream(t *testing.T) {
+	var api = newFakeAPI(t,
+		sse(
+			`{"choices": [{"index": 0, "delta": {"role": "assistant", "content": "Let me "}}]}`,
+			`{"choices": [{"index": 0, "delta": {"content": "check."}}]}`,
+			`{"choices": [{"index": 0, "delta": {"tool_calls": [{"index": 0, "id": "call_1", "type": "function", "function": {"name": "weather", "arguments": ""}}]}}]}`,
+			`{"choices": [{"index": 0, "delta": {"tool_calls": [{"index": 0, "function": {"arguments": "{\"city\":"}}]}}]}`,
+			`{"choices": [{"index": 0, "delta": {"tool_calls": [{"index": 0, "function": {"arguments": " \"Paris\"}"}}]}}]}`,
+			`{"choices": [{"index": 0, "delta": {}, "finish_reason": "tool_calls"}]}`,
+		),
+		sse(
+			`{"choices": [{"index": 0, "delta": {"role": "assistant", "content": "It's "}}]}`,
+			`{"choices": [{"index": 0, "delta": {"content": "sunny."}, "finish_reason": "stop"}]}`,
+		),
+	)
+	var events []string
+	var chat = gptease.Chat{
+		Tools: []gptease.Tool{{
+			Name:       "weather",
+			Parameters: `{"type": "object"}`,
+			Handler: func(input string) (string, error) {
+				events = append(events, "tool "+input)
+				return "sunny", nil
+			},
+		}},
+	}
+	resp, err := chat.ExchangeStream("Weather in Paris?", func(delta string) {
+		events = append(events, delta)
+	})
+	if err != nil {
+		t.Fatalf("ExchangeStream() error = %v", err)
+	}
+	if resp != "It's sunny." {
+		t.Errorf("ExchangeStream() = %q, want %q", resp, "It's sunny.")
+	}
+	var want = []string{"Let me ", "check.", `tool {"city": "Paris"}`, "It's ", "sunny."}
+	if strings.Join(events, "|") != strings.Join(want, "|") {
+		t.Errorf("events = %q, want %q", events, want)
+	}
+	if len(chat.Dialogue) != 4 || chat.Dialogue[1].Content != "Let me check." || chat.Dialogue[1].ToolCalls[0].ID != "call_1" {
+		t.Errorf("Dialogue = %+v", chat.Dialogue)
+	}
+	if api.requests[0]["stream"] != true {
+		t.Errorf("stream = %v, want true", api.requests[0]["stream"])
+	}
+}
+
+func TestMaxConcurrentStreams(t *testing.T) {
+	gptease.SetMaxConcurrentStreams(1)
+	t.Cleanup(func() { gptease.SetMaxConcurrentStreams(0) })
+	newFakeAPI(t,
+		sse(`{"choices": [{"index": 0, "delta": {"role": "assistant", "content": "One"}, "finish_reason": "stop"}]}`),
+		sse(`{"choices": [{"index": 0, "delta": {"role": "assistant", "content": "Two"}, "finish_reason": "stop"}]}`),
+	)
+
+	// The second stream can only start once the first is done.
+	var started = make(chan struct{})
+	var proceed = make(chan struct{})
+	var done = make(chan string)
+	go func() {
+		var chat gptease.Chat
+		resp, _ := chat.ExchangeStream("First", func(string) {
+			close(started)
+			<-proceed
+		})
+		done <- resp
+	}()
+	<-started
+	go func() {
+		var chat gptease.Chat
+		resp, _ := chat.ExchangeStream("Second", func(string) {})
+		done <- resp
+	}()
+	select {
+	case resp := <-done:
+		t.Fatalf("stream %q finished while the first was blocked", resp)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(proceed)
+	if first, second := <-done, <-done; first != "One" || second != "Two" {
+		t.Errorf("responses = %q, %q, want One, Two", first, second)
+	}
+}
+
+func TestStreamSSE(t *testing.T) {
+	newFakeAPI(t, sse(
+		`{"choices": [{"index": 0, "delta": {"role": "assistant", "content": "Hello"}}]}`,
+		`{"choices": [{"index": 0, "delta": {"content": "\nworld"}, "finish_reason": "stop"}]}`,
+	))
+	var chat gptease.Chat
+	var w = httptest.NewRecorder()
+	if err := chat.StreamSSE(w, "Hi"); err != nil {
+		t.Fatalf("StreamSSE() error = %v", err)
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", got)
+	}
+	var want = "data: Hello\n\ndata: \ndata: world\n\ndata: [DONE]\n\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+	if !w.Flushed {
+		t.Errorf("response was not flushed")
+	}
+}
@@ -0,0 +1,380 @@
+package gptease
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ExchangeInto is like Exchange, but asks the AI to respond with JSON that
+// matches the type of v, which must be a pointer to a struct, and decodes the
+// response into v. The JSON Schema describing the response is generated from
+// the struct the same way as for MakeTool, so field tags can be used to
+// describe the fields.
+//
+// The schema is enforced in strict mode, guaranteeing that the response
+// matches it, unless the struct has maps, interface fields or "requires"
+// tags, which strict mode doesn't support. In strict mode, fields that
+// aren't required may be null, leaving them at their zero value.
+//
+// The name of the struct type is used as the name of the schema. Use
+// ExchangeIntoSchema to provide a more descriptive name, and a description,
+// which helps the AI to respond in the intended way.
+//
+// Structured output requires a client created by this package, see
+// NewClient, and a model that supports it.
+func (c *Chat) ExchangeInto(content string, v any) error {
+	return c.ExchangeIntoSchema(content, "", "", v)
+}
+
+// ExchangeIntoSchema is like ExchangeInto, but with a name and description of
+// the schema. If name is empty, the name of the struct type is used.
+func (c *Chat) ExchangeIntoSchema(content, name, description string, v any) error {
+	return c.exchangeInto(content, name, description, v, nil)
+}
+
+// ExchangeIntoStream is like ExchangeInto, but the response is streamed,
+// calling onDelta with each piece of the JSON as it's generated, see
+// TalkStream.
+//
+// If ValidateStreamedOutput is set on the chat, the JSON generated so far is
+// checked against the schema as it arrives, and the stream is aborted with
+// ErrUnexpectedResponse as soon as it can't possibly match. This saves
+// tokens when a long response goes off the rails early. The check is best
+// effort: it catches values of the wrong type and strings that don't match
+// any allowed value, but a response passing it can still turn out invalid
+// once complete.
+func (c *Chat) ExchangeIntoStream(content string, v any, onDelta func(delta string)) error {
+	if onDelta == nil {
+		onDelta = func(string) {}
+	}
+	return c.exchangeInto(content, "", "", v, onDelta)
+}
+
+func (c *Chat) exchangeInto(content, name, description string, v any, onDelta func(string)) error {
+	defer c.watchDialogue()()
+	var t = reflect.TypeOf(v)
+	if t == nil || t.Kind() != reflect.Pointer || t.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("structured output must be decoded into a pointer to a struct, not %v", t)
+	}
+	if name == "" {
+		name = schemaName(t.Elem())
+	}
+	var spec = readSpec(t.Elem())
+	var opts = c.options()
+	opts.setField("response_format", responseFormat(name, description, spec))
+	opts.onDelta = onDelta
+	if onDelta != nil && c.ValidateStreamedOutput {
+		// Check against the schema as sent, which may allow nulls.
+		var schema, ok = strictSchema(spec)
+		if !ok {
+			b, _ := json.Marshal(spec)
+			_ = json.Unmarshal(b, &schema)
+		}
+		opts.checkPartial = func(partial string) error {
+			return checkPartialJSON(partial, schema)
+		}
+	}
+	var before = c.Dialogue
+	resp, err := c.exchange(content, &opts)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(resp), v); err != nil {
+		c.Dialogue = before
+		return fmt.Errorf("%w: %v", ErrUnexpectedResponse, err)
+	}
+	return nil
+}
+
+// checkPartialJSON checks whether JSON that is still being generated can
+// possibly match a schema, returning an error if it can't.
+func checkPartialJSON(partial string, schema any) error {
+	var v any
+	if err := json.Unmarshal([]byte(RepairJSON(partial)), &v); err != nil {
+		// Probably cut off somewhere RepairJSON can't handle. We'll know
+		// once more has arrived.
+		return nil
+	}
+	var errs SchemaErrors
+	validatePartialValue("response", schema, v, &errs)
+	if len(errs) > 0 {
+		metrics.IncErrors("unexpected_response")
+		return fmt.Errorf("%w: response diverged from schema: %v", ErrUnexpectedResponse, errs)
+	}
+	return nil
+}
+
+// Extract asks the AI to extract information from a text, such as the name,
+// date and amount of an invoice, and returns it as a T, which must be a
+// struct. The fields to extract are described by the struct, the same way as
+// for ExchangeInto, so field tags can be used to describe them.
+//
+// The instruction tells the AI what to extract. If empty, it's simply told to
+// extract the information from the text. Either way, it's told to leave any
+// fields that the text doesn't give any information about empty.
+func Extract[T any](text, instruction string) (T, error) {
+	var v T
+	if instruction == "" {
+		instruction = "Extract information from the text given by the user."
+	}
+	var chat Chat
+	chat.Instruction(instruction + " Only use information stated in the text, and leave fields empty if the text doesn't say.")
+	err := chat.ExchangeInto(text, &v)
+	return v, err
+}
+
+// responseFormat makes the value of the response_format parameter asking for
+// JSON matching a schema. The schema is enforced in strict mode, unless it
+// uses something strict mode doesn't support, see strictSchema.
+func responseFormat(name, description string, schema any) map[string]any {
+	var format = map[string]any{
+		"name":   name,
+		"schema": schema,
+	}
+	if strict, ok := strictSchema(schema); ok {
+		format["schema"] = strict
+		format["strict"] = true
+	}
+	if description != "" {
+		format["description"] = description
+	}
+	return map[string]any{
+		"type":        "json_schema",
+		"json_schema": format,
+	}
+}
+
+// strictSchema returns a copy of a schema adapted to the strict mode of
+// structured output, where the response is guaranteed to match the schema.
+// Strict mode requires every object to disallow additional properties, and
+// to list all its properties as required, so properties that aren't
+// required are made nullable instead. It reports false if the schema can't
+// be used in strict mode, such as when it describes a map, any value, or
+// dependent required properties.
+func strictSchema(schema any) (any, bool) {
+	b, err := json.Marshal(schema)
+	if err != nil {
+		return nil, false
+	}
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, false
+	}
+	if !makeStrict(v) {
+		return nil, false
+	}
+	return v, true
+}
+
+func makeStrict(schema any) bool {
+	s, ok := schema.(map[string]any)
+	if !ok || s["type"] == nil {
+		return false
+	}
+	if _, ok := s["dependentRequired"]; ok {
+		return false
+	}
+	if items, ok := s["items"]; ok && !makeStrict(items) {
+		return false
+	}
+	if s["type"] != "object" {
+		return true
+	}
+	if _, ok := s["additionalProperties"]; ok {
+		return false
+	}
+	var required = map[string]bool{}
+	if req, ok := s["required"].([]any); ok {
+		for _, r := range req {
+			if r, ok := r.(string); ok {
+				required[r] = true
+			}
+		}
+	}
+	var props, _ = s["properties"].(map[string]any)
+	var names = make([]string, 0, len(props))
+	for name, p := range props {
+		if !makeStrict(p) {
+			return false
+		}
+		if !required[name] {
+			var p = p.(map[string]any)
+			p["type"] = []any{p["type"], "null"}
+			if enum, ok := p["enum"].([]any); ok {
+				p["enum"] = append(enum, nil)
+			}
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var all = make([]any, len(names))
+	for i, n := range names {
+		all[i] = n
+	}
+	s["required"] = all
+	s["additionalProperties"] = false
+	return true
+}
+
+var invalidSchemaNameChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// schemaName makes a schema name out of the name of a type. The API only
+// allows letters, digits, underscores and dashes.
+func schemaName(t reflect.Type) string {
+	var name = invalidSchemaNameChars.ReplaceAllString(t.Name(), "_")
+	if name == "" {
+		return "response"
+	}
+	return name
+}
+
+// classifyAttempts is the number of times Classify asks the AI before giving
+// up on getting one of the labels.
+const classifyAttempts = 3
+
+// Classify asks the AI which of the labels best fits the text, and returns
+// that label. The response is constrained to the labels using structured
+// output in strict mode. The label is checked all the same, and if the AI
+// still responds with something else, it's asked again a couple of times
+// before failing with ErrUnexpectedResponse.
+//
+// The instruction describes the classification task, such as "Classify the
+// sentiment of the review." If empty, the AI is simply told to pick the label
+// that best fits. Either way, the AI is told what the labels are.
+//
+// Like ExchangeInto, this requires a client created by this package, see
+// NewClient, and a model that supports structured output.
+func Classify(text string, labels []string, instruction string) (string, error) {
+	if len(labels) == 0 {
+		return "", fmt.Errorf("no labels to classify into")
+	}
+	if instruction == "" {
+		instruction = "Classify the text given by the user, picking the label that fits it best."
+	}
+	instruction += "\n\nThe labels are: " + strings.Join(labels, ", ")
+	var enum = make([]any, len(labels))
+	for i, l := range labels {
+		enum[i] = l
+	}
+	var schema = fieldSpec{
+		Type:       "object",
+		Properties: &fieldMap{"label": {Type: "string", Enum: enum}},
+		Required:   []string{"label"},
+	}
+
+	var err error
+	for attempt := 0; attempt < classifyAttempts; attempt++ {
+		var chat Chat
+		chat.Instruction(instruction)
+		var opts = chat.options()
+		opts.setField("response_format", responseFormat("classification", "", schema))
+		var resp string
+		if resp, err = chat.exchange(text, &opts); err != nil {
+			return "", err
+		}
+		var out struct {
+			Label string `json:"label"`
+		}
+		if jerr := json.Unmarshal([]byte(resp), &out); jerr != nil {
+			err = fmt.Errorf("%w: %v", ErrUnexpectedResponse, jerr)
+			continue
+		}
+		for _, l := range labels {
+			if out.Label == l {
+				return l, nil
+			}
+		}
+		err = fmt.Errorf("%w: %q is not one of the labels", ErrUnexpectedResponse, out.Label)
+	}
+	return "", err
+}
+
+// Form collects information from the user over the course of a
+// conversation, filling in a T, which must be a struct, as it's given. Each
+// message from the user may give any number of fields, and the AI responds
+// with a reply, such as asking for what's still missing, along with the
+// fields the message gave, which are merged into the form.
+//
+// The fields of T are described the same way as for ExchangeInto, so field
+// tags can be used to describe them. Give the Chat an instruction telling
+// the AI what the form is for and how to go about it.
+//
+// Fields are merged such that any field the AI gives a value other than the
+// zero value, such as an empty string or 0, replaces the value of the field
+// in the form, while fields left out, null or given a zero value are left as
+// they are. Fields of nested structs are merged the same way, while slices
+// and maps are replaced as a whole. This means that a field can't be reset to
+// its zero value by the AI, so use pointers for fields where the zero value
+// is a meaningful answer, such as a number of children.
+//
+// Like ExchangeInto, this requires a client created by this package, see
+// NewClient, and a model that supports structured output.
+type Form[T any] struct {
+	Chat  Chat
+	value T
+}
+
+// Exchange adds a message from the user to the dialogue of the form, merges
+// any information it gives into the form, and returns the reply of the AI.
+// If there was an error, neither the dialogue nor the form is modified.
+func (f *Form[T]) Exchange(content string) (reply string, err error) {
+	defer f.Chat.watchDialogue()()
+	var t = reflect.TypeOf(&f.value).Elem()
+	if t.Kind() != reflect.Struct {
+		return "", fmt.Errorf("form must be a struct, not %v", t)
+	}
+	var update = readSpec(t)
+	// Only what the latest message gives is expected.
+	update.Required = nil
+	update.Description = strings.TrimSpace("The information given in the latest message from the user, leaving out anything not given. " + update.Description)
+	var schema = fieldSpec{
+		Type: "object",
+		Properties: &fieldMap{
+			"reply":  {Type: "string", Description: "What to say to the user, such as asking for missing information."},
+			"update": update,
+		},
+		Required: []string{"reply", "update"},
+	}
+	var opts = f.Chat.options()
+	opts.setField("response_format", responseFormat(schemaName(t), "", schema))
+	var before = f.Chat.Dialogue
+	resp, err := f.Chat.exchange(content, &opts)
+	if err != nil {
+		return "", err
+	}
+	var out struct {
+		Reply  string `json:"reply"`
+		Update T      `json:"update"`
+	}
+	if err := json.Unmarshal([]byte(resp), &out); err != nil {
+		f.Chat.Dialogue = before
+		return "", fmt.Errorf("%w: %v", ErrUnexpectedResponse, err)
+	}
+	mergeNonZero(reflect.ValueOf(&f.value).Elem(), reflect.ValueOf(out.Update))
+	return out.Reply, nil
+}
+
+// Value returns the information collected so far.
+func (f *Form[T]) Value() T {
+	return f.value
+}
+
+// mergeNonZero sets the fields of the struct dst to the values of the fields
+// of src that aren't zero, recursing into nested structs.
+func mergeNonZero(dst, src reflect.Value) {
+	for i := 0; i < src.NumField(); i++ {
+		var d, s = dst.Field(i), src.Field(i)
+		switch {
+		case !d.CanSet():
+			// Unexported, so it can't have been decoded anyway.
+		case s.Kind() == reflect.Struct:
+			mergeNonZero(d, s)
+		case !s.IsZero():
+			d.Set(s)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package gptease_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Volumental/gptease"
+)
+
+type recipe struct {
+	Title       string   `json:"title"`
+	Ingredients []string `json:"ingredients" desc:"one ingredient per item"`
+}
+
+func TestExchangeInto(t *testing.T) {
+	var api = newFakeAPI(t, `{
+		"choices": [{
+			"message": {"role": "assistant", "content": "{\"title\": \"Eggs\", \"ingredients\": [\"egg\", \"butter\"]}"},
+			"finish_reason": "stop"
+		}]
+	}`)
+	var chat gptease.Chat
+	var r recipe
+	if err := chat.ExchangeIntoSchema("Scrambled eggs?", "", "A cooking recipe.", &r); err != nil {
+		t.Fatalf("ExchangeInto() error = %v", err)
+	}
+	if r.Title != "Eggs" || len(r.Ingredients) != 2 {
+		t.Errorf("decoded %+v", r)
+	}
+
+	var format = api.requests[0]["response_format"].(map[string]any)
+	var schema = format["json_schema"].(map[string]any)
+	if format["type"] != "json_schema" || schema["name"] != "recipe" || schema["description"] != "A cooking recipe." {
+		t.Errorf("response_format = %v", format)
+	}
+	if schema["strict"] != true {
+		t.Errorf("strict = %v, want true", schema["strict"])
+	}
+	var body = schema["schema"].(map[string]any)
+	if body["additionalProperties"] != false || len(body["required"].([]any)) != 2 {
+		t.Errorf("schema = %v, want no additional properties and all required", body)
+	}
+
+	if err := chat.ExchangeInto("Again?", r); err == nil {
+		t.Errorf("ExchangeInto(non-pointer) error = nil, want error")
+	}
+}
+
+func TestClassify(t *testing.T) {
+	var api = newFakeAPI(t,
+		`{"choices": [{"message": {"role": "assistant", "content": "{\"label\": \"meh\"}"}, "finish_reason": "stop"}]}`,
+		`{"choices": [{"message": {"role": "assistant", "content": "{\"label\": \"negative\"}"}, "finish_reason": "stop"}]}`,
+	)
+	label, err := gptease.Classify("The soup was cold.", []string{"positive", "negative"}, "Classify the sentiment of the review.")
+	if err != nil {
+		t.Fatalf("Classify() error = %v", err)
+	}
+	if label != "negative" {
+		t.Errorf("Classify() = %q, want %q", label, "negative")
+	}
+	if len(api.requests) != 2 {
+		t.Errorf("made %d requests, want 2", len(api.requests))
+	}
+	var schema = api.requests[0]["response_format"].(map[string]any)["json_schema"].(map[string]any)["schema"].(map[string]any)
+	var enum = schema["properties"].(map[string]any)["label"].(map[string]any)["enum"].([]any)
+	if len(enum) != 2 || enum[0] != "positive" || enum[1] != "negative" {
+		t.Errorf("enum = %v, want the labels", enum)
+	}
+}
+
+func TestClassifyUnknownLabel(t *testing.T) {
+	const meh = `{"choices": [{"message": {"role": "assistant", "content": "{\"label\": \"meh\"}"}, "finish_reason": "stop"}]}`
+	var api = newFakeAPI(t, meh, meh, meh)
+	label, err := gptease.Classify("The soup was cold.", []string{"positive", "negative"}, "")
+	if !errors.Is(err, gptease.ErrUnexpectedResponse) || label != "" {
+		t.Errorf("Classify() = %q, %v, want %v", label, err, gptease.ErrUnexpectedResponse)
+	}
+	if len(api.requests) != 3 {
+		t.Errorf("made %d requests, want 3", len(api.requests))
+	}
+	if format := api.requests[0]["response_format"].(map[string]any)["json_schema"].(map[string]any); format["strict"] != true {
+		t.Errorf("strict = %v, want true", format["strict"])
+	}
+}
+
+func TestExtract(t *testing.T) {
+	type invoice struct {
+		Name   string  `json:"name"`
+		Amount float64 `json:"amount" desc:"total amount due"`
+	}
+	var api = newFakeAPI(t, `{"choices": [{"message": {"role": "assistant", "content": "{\"name\": \"ACME\", \"amount\": 12.5}"}, "finish_reason": "stop"}]}`)
+	got, err := gptease.Extract[invoice]("Invoice from ACME. Total: $12.50", "")
+	if err != nil {
+		t.Fatalf("Extract() error = %v", err)
+	}
+	if got != (invoice{Name: "ACME", Amount: 12.5}) {
+		t.Errorf("Extract() = %+v", got)
+	}
+	var messages = api.requests[0]["messages"].([]any)
+	if len(messages) != 2 || messages[0].(map[string]any)["role"] != "system" {
+		t.Errorf("messages = %v, want an instruction and the text", messages)
+	}
+}
+
+func TestExchangeIntoStream(t *testing.T) {
+	newFakeAPI(t, sse(
+		`{"choices": [{"index": 0, "delta": {"role": "assistant", "content": "{\"title\": \"Eg"}}]}`,
+		`{"choices": [{"index": 0, "delta": {"content": "gs\", \"ingredients\": [\"egg\"]}"}, "finish_reason": "stop"}]}`,
+	))
+	var chat gptease.Chat
+	var r recipe
+	var streamed string
+	if err := chat.ExchangeIntoStream("Eggs?", &r, func(d string) { streamed += d }); err != nil {
+		t.Fatalf("ExchangeIntoStream() error = %v", err)
+	}
+	if r.Title != "Eggs" || len(r.Ingredients) != 1 || streamed != `{"title": "Eggs", "ingredients": ["egg"]}` {
+		t.Errorf("decoded %+v, streamed %q", r, streamed)
+	}
+
+	// The stream is aborted once it goes off the schema.
+	newFakeAPI(t, sse(
+		`{"choices": [{"index": 0, "delta": {"role": "assistant", "content": "{\"title\": \"Eggs\", \"ingredients\": "}}]}`,
+		`{"choices": [{"index": 0, "delta": {"content": "\"egg"}}]}`,
+		`{"choices": [{"index": 0, "delta": {"content": "\"}"}, "finish_reason": "stop"}]}`,
+	))
+	chat = gptease.Chat{ValidateStreamedOutput: true}
+	streamed = ""
+	err := chat.ExchangeIntoStream("Eggs?", &r, func(d string) { streamed += d })
+	if !errors.Is(err, gptease.ErrUnexpectedResponse) {
+		t.Fatalf("ExchangeIntoStream() error = %v, want %v", err, gptease.ErrUnexpectedResponse)
+	}
+	if strings.HasSuffix(streamed, "}") {
+		t.Errorf("streamed %q, want it aborted early", streamed)
+	}
+	if len(chat.Dialogue) != 0 {
+		t.Errorf("len(Dialogue) = %d, want 0", len(chat.Dialogue))
+	}
+}
+
+type booking struct {
+	Name   string `json:"name"`
+	Guests *int   `json:"guests" desc:"number of guests"`
+	Date   struct {
+		Day   int    `json:"day"`
+		Month string `json:"month"`
+	} `json:"date"`
+}
+
+func TestForm(t *testing.T) {
+	var api = newFakeAPI(t,
+		`{"choices": [{"message": {"role": "assistant", "content": "{\"reply\": \"For how many?\", \"update\": {\"name\": \"Ada\", \"date\": {\"day\": 3, \"month\": \"May\"}}}"}, "finish_reason": "stop"}]}`,
+		`{"choices": [{"message": {"role": "assistant", "content": "{\"reply\": \"Booked!\", \"update\": {\"name\": \"\", \"guests\": 0, \"date\": {\"day\": 4}}}"}, "finish_reason": "stop"}]}`,
+	)
+	var form gptease.Form[booking]
+	form.Chat.Instruction("Take a table booking.")
+	reply, err := form.Exchange("A table for Ada on May 3rd.")
+	if err != nil || reply != "For how many?" {
+		t.Fatalf("Exchange() = %q, %v", reply, err)
+	}
+	var format = api.requests[0]["response_format"].(map[string]any)["json_schema"].(map[string]any)
+	var update = format["schema"].(map[string]any)["properties"].(map[string]any)["update"].(map[string]any)
+	// Strict mode requires all fields, so leaving them out means null.
+	for name, p := range update["properties"].(map[string]any) {
+		if types, _ := p.(map[string]any)["type"].([]any); len(types) != 2 || types[1] != "null" {
+			t.Errorf("update field %s has type %v, want it nullable", name, types)
+		}
+	}
+
+	if reply, err = form.Exchange("Just me, and make it the 4th."); err != nil || reply != "Booked!" {
+		t.Fatalf("Exchange() = %q, %v", reply, err)
+	}
+	var got = form.Value()
+	if got.Name != "Ada" || got.Guests == nil || *got.Guests != 0 || got.Date.Day != 4 || got.Date.Month != "May" {
+		t.Errorf("Value() = %+v", got)
+	}
+	if len(form.Chat.Dialogue) != 5 {
+		t.Errorf("Dialogue = %v", contents(form.Chat.Dialogue))
+	}
+}
@@ -0,0 +1,59 @@
+package gptease
+
+import (
+	"fmt"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// TitleModel is the model used by GenerateTitle. A cheap model is good
+// enough for the task. If empty, the model of the chat is used, which is
+// needed when using an API that doesn't serve OpenAI's models.
+var TitleModel = openai.GPT3Dot5Turbo
+
+const titleInstruction = "Write a short title, of a few words, summarizing the conversation given by the user, as for a list of conversations. Respond with the title only."
+
+// GenerateTitle asks the AI for a short title summarizing the conversation
+// so far, such as for listing conversations in a chat application. It's done
+// in a separate request, with the messages from the user and the AI as
+// context, so the dialogue is left unchanged. See TitleModel for the model
+// used.
+func (c *Chat) GenerateTitle() (string, error) {
+	var transcript strings.Builder
+	for _, m := range c.Dialogue {
+		var content = m.Content
+		for _, p := range m.MultiContent {
+			if p.Type == openai.ChatMessagePartTypeText {
+				content += p.Text
+			}
+		}
+		if content == "" {
+			continue
+		}
+		switch m.Role {
+		case openai.ChatMessageRoleUser:
+			fmt.Fprintf(&transcript, "User: %s\n\n", content)
+		case openai.ChatMessageRoleAssistant:
+			fmt.Fprintf(&transcript, "AI: %s\n\n", content)
+		}
+	}
+	if transcript.Len() == 0 {
+		return "", fmt.Errorf("nothing to summarize")
+	}
+	var titler = Chat{
+		Model:                TitleModel,
+		Headers:              c.Headers,
+		NoDefaultInstruction: true,
+		c:                    c.c,
+	}
+	if titler.Model == "" {
+		titler.Model = c.model()
+	}
+	titler.Instruction(titleInstruction)
+	title, err := titler.Exchange(transcript.String())
+	if err != nil {
+		return "", err
+	}
+	return strings.Trim(strings.TrimSpace(title), `"'.`), nil
+}
@@ -0,0 +1,33 @@
+package gptease_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Volumental/gptease"
+)
+
+func TestGenerateTitle(t *testing.T) {
+	var api = newFakeAPI(t, `{"choices": [{"message": {"role": "assistant", "content": "\"Cooking Scrambled Eggs\""}, "finish_reason": "stop"}]}`)
+	var chat gptease.Chat
+	chat.Instruction("Talk like a pirate.")
+	chat.ExampleExchange("How do I cook scrambled eggs?", "Arr, whisk them eggs!")
+	title, err := chat.GenerateTitle()
+	if err != nil {
+		t.Fatalf("GenerateTitle() error = %v", err)
+	}
+	if title != "Cooking Scrambled Eggs" {
+		t.Errorf("GenerateTitle() = %q", title)
+	}
+	if len(chat.Dialogue) != 3 {
+		t.Errorf("Dialogue = %v, want it unchanged", contents(chat.Dialogue))
+	}
+	var messages = api.requests[0]["messages"].([]any)
+	var transcript = messages[len(messages)-1].(map[string]any)["content"].(string)
+	if !strings.Contains(transcript, "scrambled eggs") || strings.Contains(transcript, "pirate") {
+		t.Errorf("transcript = %q, want the conversation without instructions", transcript)
+	}
+	if api.requests[0]["model"] != gptease.TitleModel {
+		t.Errorf("model = %v, want %v", api.requests[0]["model"], gptease.TitleModel)
+	}
+}
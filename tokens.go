@@ -0,0 +1,157 @@
+package gptease
+
+import (
+	"encoding/json"
+	"regexp"
+	"sync"
+	"unicode/utf8"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Tokenizer counts the tokens in a text, as seen by a particular model. It's
+// used wherever the package needs to know how large a text is, for example
+// to estimate the cost of a request.
+type Tokenizer interface {
+	Count(text string) int
+}
+
+// Encoder is a Tokenizer that can also turn a text into the ids of its
+// tokens. It's needed for features referring to individual tokens, such as
+// Chat.BiasWords. The tokenizer used by default can only estimate counts, so
+// register an Encoder with RegisterTokenizer to use them.
+type Encoder interface {
+	Tokenizer
+	Encode(text string) []int
+}
+
+var (
+	tokenizersMu sync.RWMutex
+	tokenizers   = map[string]Tokenizer{}
+)
+
+// RegisterTokenizer sets the tokenizer to use for a model. This is useful
+// when using an OpenAI-compatible API serving a different family of models,
+// whose tokenization differs from OpenAI's.
+func RegisterTokenizer(model string, t Tokenizer) {
+	tokenizersMu.Lock()
+	defer tokenizersMu.Unlock()
+	tokenizers[model] = t
+}
+
+// TokenizerFor returns the tokenizer to use for a model. Unless another one
+// has been registered with RegisterTokenizer, it's an approximation of the
+// tokenizer used by OpenAI's GPT-3.5 and GPT-4 models.
+func TokenizerFor(model string) Tokenizer {
+	tokenizersMu.RLock()
+	defer tokenizersMu.RUnlock()
+	if t, ok := tokenizers[model]; ok {
+		return t
+	}
+	return approxTokenizer{}
+}
+
+// pretokenize splits text the same way as the cl100k_base encoding does,
+// before it applies byte pair encoding to each piece.
+var pretokenize = regexp.MustCompile(`(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\pL\pN]?\pL+|\pN{1,3}| ?[^\s\pL\pN]+[\r\n]*|\s*[\r\n]+|\s+`)
+
+// approxTokenizer estimates the number of tokens of OpenAI's cl100k_base
+// encoding without the large vocabulary that would be needed to do it
+// exactly. Common words are a single token, while long words and non-latin
+// script end up as several.
+type approxTokenizer struct{}
+
+func (approxTokenizer) Count(text string) int {
+	var n int
+	for _, piece := range pretokenize.FindAllString(text, -1) {
+		var runes = utf8.RuneCountInString(piece)
+		switch {
+		case runes != len(piece):
+			// Non-ASCII text is typically one token per character or so.
+			n += runes
+		case piece[len(piece)-1] >= '0' && piece[len(piece)-1] <= '9':
+			n++
+		default:
+			n += (runes + 5) / 6
+		}
+	}
+	return n
+}
+
+// countTokens estimates the number of prompt tokens used by a list of
+// messages, including the overhead of the chat format.
+func countTokens(t Tokenizer, msgs []openai.ChatCompletionMessage) int {
+	var n = 3 // Every reply is primed with the start of an assistant message.
+	for _, m := range msgs {
+		n += 3 + t.Count(m.Role) + t.Count(m.Content) + t.Count(m.Name)
+		for _, p := range m.MultiContent {
+			n += t.Count(p.Text)
+		}
+		for _, tc := range m.ToolCalls {
+			n += t.Count(tc.Function.Name) + t.Count(tc.Function.Arguments)
+		}
+	}
+	return n
+}
+
+// estimateTokens gives an estimate of the number of tokens a request will
+// consume, counting both the prompt and the room left for the response.
+func estimateTokens(req openai.ChatCompletionRequest) int {
+	return promptTokens(req) + req.MaxTokens
+}
+
+// promptTokens estimates the number of prompt tokens of a request, including
+// the tool definitions.
+func promptTokens(req openai.ChatCompletionRequest) int {
+	var t = TokenizerFor(req.Model)
+	return countTokens(t, req.Messages) + countToolTokens(t, req.Tools)
+}
+
+// countToolTokens estimates the number of prompt tokens used by the
+// definitions of tools.
+func countToolTokens(t Tokenizer, tools []openai.Tool) int {
+	var n int
+	for _, tool := range tools {
+		n += t.Count(tool.Function.Name) + t.Count(tool.Function.Description)
+		if p, ok := tool.Function.Parameters.(json.RawMessage); ok {
+			n += t.Count(string(p))
+		}
+	}
+	return n
+}
+
+// trimToFit drops the oldest messages of a dialogue until it fits within
+// maxTokens, and returns the messages kept along with the number dropped.
+// Leading instructions are always kept, and so is the most recent message
+// from the user and everything after it, even if that doesn't fit. A tool
+// call is never separated from its results. The dialogue is not modified.
+func trimToFit(d Dialogue, t Tokenizer, maxTokens int) (kept Dialogue, dropped int) {
+	var n int
+	for n < len(d) && d[n].Role == openai.ChatMessageRoleSystem {
+		n++
+	}
+	var protected = len(d)
+	for protected > n && d[protected-1].Role != openai.ChatMessageRoleUser {
+		protected--
+	}
+	if protected > n {
+		// Keep the user message itself too.
+		protected--
+	} else {
+		protected = len(d)
+	}
+	var tokens, cut = countTokens(t, d), n
+	for tokens > maxTokens && cut < protected {
+		// The 3 tokens priming the response are not part of any message.
+		tokens -= countTokens(t, d[cut:cut+1]) - 3
+		cut++
+		for cut < protected && d[cut].Role == openai.ChatMessageRoleTool {
+			tokens -= countTokens(t, d[cut:cut+1]) - 3
+			cut++
+		}
+	}
+	if cut == n {
+		return d, 0
+	}
+	return append(append(Dialogue(nil), d[:n]...), d[cut:]...), cut - n
+}
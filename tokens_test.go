@@ -0,0 +1,117 @@
+package gptease_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Volumental/gptease"
+)
+
+type wordCounter struct{}
+
+func (wordCounter) Count(text string) int { return len(strings.Fields(text)) }
+
+func TestTokenizer(t *testing.T) {
+	var tok = gptease.TokenizerFor("gpt-4")
+	tests := []struct {
+		text     string
+		min, max int
+	}{
+		{"", 0, 0},
+		{"hello", 1, 1},
+		{"Hello, world!", 3, 5},
+		{"The quick brown fox jumps over the lazy dog.", 9, 12},
+		{"1234567", 2, 4},
+		{"こんにちは", 3, 10},
+	}
+	for _, tt := range tests {
+		if got := tok.Count(tt.text); got < tt.min || got > tt.max {
+			t.Errorf("Count(%q) = %d, want between %d and %d", tt.text, got, tt.min, tt.max)
+		}
+	}
+
+	gptease.RegisterTokenizer("my-llama", wordCounter{})
+	if got := gptease.TokenizerFor("my-llama").Count("one two three"); got != 3 {
+		t.Errorf("registered tokenizer Count() = %d, want 3", got)
+	}
+}
+
+// byteEncoder encodes each byte as a token, with the byte as its id.
+type byteEncoder struct{}
+
+func (byteEncoder) Count(text string) int { return len(text) }
+
+func (byteEncoder) Encode(text string) []int {
+	var ids []int
+	for _, b := range []byte(text) {
+		ids = append(ids, int(b))
+	}
+	return ids
+}
+
+// biasWordsRuns makes the model of each run of TestBiasWords unique, as
+// tokenizers can't be unregistered.
+var biasWordsRuns int
+
+func TestBiasWords(t *testing.T) {
+	biasWordsRuns++
+	var model = fmt.Sprintf("%s-%d", t.Name(), biasWordsRuns)
+	var chat = gptease.Chat{Model: model}
+	if err := chat.BiasWords(map[string]int{"a": -100}); err == nil {
+		t.Errorf("BiasWords() without encoder = nil, want error")
+	}
+	gptease.RegisterTokenizer(model, byteEncoder{})
+	if err := chat.BiasWords(map[string]int{"ab": -100}); err != nil {
+		t.Fatalf("BiasWords() error = %v", err)
+	}
+	var want = map[string]int{"97": -100, "98": -100, "32": -100}
+	if len(chat.Tweaks.LogitBias) != len(want) {
+		t.Errorf("LogitBias = %v, want %v", chat.Tweaks.LogitBias, want)
+	}
+	for id, b := range want {
+		if chat.Tweaks.LogitBias[id] != b {
+			t.Errorf("LogitBias = %v, want %v", chat.Tweaks.LogitBias, want)
+		}
+	}
+	if err := chat.BiasWords(map[string]int{"c": 101}); err == nil {
+		t.Errorf("BiasWords() with bias 101 = nil, want error")
+	}
+}
+
+func TestTrim(t *testing.T) {
+	gptease.RegisterTokenizer("my-words", wordCounter{})
+	var newChat = func() gptease.Chat {
+		var chat = gptease.Chat{Model: "my-words", NoDefaultInstruction: true}
+		// With 4 tokens of overhead per message, and 3 for the response,
+		// this adds up to 29 tokens.
+		chat.Instruction("Be brief.")
+		chat.ExampleExchange("one two three four", "five six")
+		chat.UserSaid("seven eight")
+		return chat
+	}
+
+	var chat = newChat()
+	if removed := chat.Trim(22); removed != 1 || len(chat.Dialogue) != 3 || chat.Dialogue[1].Content != "five six" {
+		t.Errorf("Trim(22) = %d, Dialogue = %v", removed, contents(chat.Dialogue))
+	}
+	// The instruction and the latest message from the user are kept, even
+	// if they don't fit.
+	chat = newChat()
+	if removed := chat.Trim(1); removed != 2 || len(chat.Dialogue) != 2 || chat.Dialogue[1].Content != "seven eight" {
+		t.Errorf("Trim(1) = %d, Dialogue = %v", removed, contents(chat.Dialogue))
+	}
+
+	var api = newFakeAPI(t, `{"choices": [{"message": {"role": "assistant", "content": "Nine."}, "finish_reason": "stop"}]}`)
+	chat = newChat()
+	chat.MaxContextTokens = 22
+	if _, err := chat.Talk(); err != nil {
+		t.Fatalf("Talk() error = %v", err)
+	}
+	if n := len(api.requests[0]["messages"].([]any)); n != 3 {
+		t.Errorf("sent %d messages, want 3", n)
+	}
+	if len(chat.Dialogue) != 5 {
+		t.Errorf("Dialogue = %v, want nothing removed", contents(chat.Dialogue))
+	}
+}
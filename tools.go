@@ -1,18 +1,89 @@
 package gptease
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"reflect"
+	"strconv"
 	"strings"
+	"time"
 
 	openai "github.com/sashabaranov/go-openai"
 )
 
+// Tool describes a function that the AI may call to help it generate a
+// response. Parameters is a JSON Schema describing the input to the Handler,
+// which receives the arguments from the AI as JSON and returns the result
+// that will be passed back to the AI.
+//
+// The API expects exactly one result for each tool call, and the AI can't
+// continue until all results of a turn have been provided. Results are
+// therefore always delivered whole, when the handler returns. A tool that
+// produces output gradually, like a log stream, can instead be split into one
+// tool that starts the work and another that returns the output produced so
+// far, letting the AI poll for more.
 type Tool struct {
 	Name        string
 	Description string
 	Parameters  string
 	Handler     func(input string) (output string, err error)
+
+	// RateLimiter, if set, limits how often the Handler is invoked, for
+	// tools calling external services with rate limits of their own. Calls
+	// block until there is capacity. Only its requests-per-minute limit
+	// applies, so create it with NewRateLimiter(rpm, 0).
+	RateLimiter *RateLimiter
+
+	// RequiresApproval makes the conversation pause before the Handler is
+	// invoked, for tools with consequences that a human should approve,
+	// such as sending money. Talk or Exchange then return an error wrapping
+	// ErrApprovalRequired, keeping the dialogue, and the call can be
+	// inspected with Chat.PendingApproval. Once approved or denied, call
+	// Chat.Resume to continue. Note that Chat.RerunTools doesn't ask for
+	// approval again.
+	RequiresApproval bool
+
+	// Timeout, if set, is how long to wait for the Handler to return. If it
+	// takes longer, the AI is told that the tool timed out, with an error
+	// wrapping ErrToolTimeout, and the conversation goes on. This suits
+	// tools backed by slow job queues, where a generous timeout keeps a
+	// stuck job from holding up the conversation forever. The handler is
+	// left running, but its result is ignored.
+	Timeout time.Duration
+}
+
+// runHandler calls the handler of a tool, giving up once its Timeout has
+// passed or ctx is done.
+func runHandler(ctx context.Context, t *Tool, input string) (string, error) {
+	if t.Timeout <= 0 && ctx.Done() == nil {
+		return t.Handler(input)
+	}
+	type result struct {
+		out string
+		err error
+	}
+	// Buffered, so that a handler given up on can still finish.
+	var done = make(chan result, 1)
+	go func() {
+		out, err := t.Handler(input)
+		done <- result{out, err}
+	}()
+	var timeout <-chan time.Time
+	if t.Timeout > 0 {
+		var timer = time.NewTimer(t.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case r := <-done:
+		return r.out, r.err
+	case <-timeout:
+		return "", fmt.Errorf("%w after %v", ErrToolTimeout, t.Timeout)
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
 }
 
 func (t *Tool) openaiTool() openai.Tool {
@@ -26,15 +97,39 @@ func (t *Tool) openaiTool() openai.Tool {
 	}
 }
 
+// MaxToolReaderOutput is the maximum number of bytes read from an io.Reader
+// returned by a tool made with MakeTool. Any output beyond that is cut off.
+var MaxToolReaderOutput int64 = 1 << 20
+
+// readToolOutput reads the output of a tool from a reader, up to the size
+// limit, and closes it if it's an io.Closer.
+func readToolOutput(r io.Reader) (string, error) {
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+	b, err := io.ReadAll(io.LimitReader(r, MaxToolReaderOutput+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(b)) > MaxToolReaderOutput {
+		return string(b[:MaxToolReaderOutput]) + "\n[output truncated]", nil
+	}
+	return string(b), nil
+}
+
 type fieldMap map[string]fieldSpec
 
 type fieldSpec struct {
-	Type        string     `json:"type"`
-	Properties  *fieldMap  `json:"properties,omitempty"`
-	Items       *fieldSpec `json:"items,omitempty"`
-	Description string     `json:"description,omitempty"`
-	Required    []string   `json:"required,omitempty"`
-	Enum        []string   `json:"enum,omitempty"`
+	Type                 string     `json:"type,omitempty"`
+	Properties           *fieldMap  `json:"properties,omitempty"`
+	AdditionalProperties *fieldSpec `json:"additionalProperties,omitempty"`
+	Items                *fieldSpec `json:"items,omitempty"`
+	Description          string     `json:"description,omitempty"`
+	Required             []string   `json:"required,omitempty"`
+	Enum                 []any      `json:"enum,omitempty"`
+	// DependentRequired lists, for some properties, other properties that
+	// are required when that property is present.
+	DependentRequired map[string][]string `json:"dependentRequired,omitempty"`
 }
 
 type spec struct {
@@ -48,17 +143,65 @@ func (s *fieldSpec) parseTag(tag reflect.StructTag) {
 		s.Description = d
 	}
 	if e, ok := tag.Lookup("enum"); ok {
-		s.Enum = strings.Split(e, ",")
+		// For slices, the enum constrains the elements rather than the
+		// slice itself.
+		var target = s
+		for target.Type == "array" {
+			target = target.Items
+		}
+		target.Enum = nil
+		for _, v := range strings.Split(e, ",") {
+			target.Enum = append(target.Enum, target.parseValue(v))
+		}
+	}
+}
+
+// parseValue parses a value given in a field tag according to the type of
+// the field.
+func (s *fieldSpec) parseValue(v string) any {
+	var parsed any
+	var err error
+	switch s.Type {
+	case "integer":
+		parsed, err = strconv.ParseInt(v, 10, 64)
+	case "number":
+		parsed, err = strconv.ParseFloat(v, 64)
+	case "boolean":
+		parsed, err = strconv.ParseBool(v)
+	default:
+		parsed = v
+	}
+	if err != nil {
+		panic(fmt.Sprintf("invalid %s value %q in tag", s.Type, v))
 	}
+	return parsed
 }
 
-func readSpec(t reflect.Type) (s fieldSpec) {
+func readSpec(t reflect.Type) fieldSpec {
+	return readSpecOf(t, map[reflect.Type]bool{})
+}
+
+// readSpecOf reads the spec of a type, given the structs it's nested in,
+// which it can't refer to as JSON Schema can't describe recursive types.
+func readSpecOf(t reflect.Type, outer map[reflect.Type]bool) (s fieldSpec) {
 	switch t.Kind() {
 	case reflect.Struct:
+		if outer[t] {
+			panic("recursive type")
+		}
+		outer[t] = true
+		defer delete(outer, t)
 		s.Type = "object"
 		s.Properties = &fieldMap{}
 		for i := 0; i < t.NumField(); i++ {
 			var f = t.Field(i)
+			if f.Name == "_" {
+				// A blank field describes the object itself.
+				if d, ok := f.Tag.Lookup("desc"); ok {
+					s.Description = d
+				}
+				continue
+			}
 			var name = f.Name
 			// If the field has a JSON tag, use that as the property name.
 			if jt := f.Tag.Get("json"); jt != "" {
@@ -67,19 +210,39 @@ func readSpec(t reflect.Type) (s fieldSpec) {
 					s.Required = append(s.Required, name)
 				}
 			}
-			var fs = readSpec(f.Type)
+			var fs = readSpecOf(f.Type, outer)
 			fs.parseTag(f.Tag)
 			(*s.Properties)[name] = fs
+			if r, ok := f.Tag.Lookup("requires"); ok {
+				if s.DependentRequired == nil {
+					s.DependentRequired = map[string][]string{}
+				}
+				s.DependentRequired[name] = strings.Split(r, ",")
+			}
 		}
 	case reflect.Slice:
 		s.Type = "array"
-		var itemSpec = readSpec(t.Elem())
+		var itemSpec = readSpecOf(t.Elem(), outer)
 		s.Items = &itemSpec
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			panic("unsupported map key type")
+		}
+		s.Type = "object"
+		var valueSpec = readSpecOf(t.Elem(), outer)
+		s.AdditionalProperties = &valueSpec
+	case reflect.Pointer:
+		// A pointer is described by what it points to, as JSON doesn't tell
+		// the difference.
+		return readSpecOf(t.Elem(), outer)
+	case reflect.Interface:
+		// Any type is allowed, which is expressed by an empty schema.
 	case reflect.String:
 		s.Type = "string"
-	case reflect.Int:
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		s.Type = "integer"
-	case reflect.Float32:
+	case reflect.Float32, reflect.Float64:
 		s.Type = "number"
 	case reflect.Bool:
 		s.Type = "boolean"
@@ -100,13 +263,32 @@ func readSpec(t reflect.Type) (s fieldSpec) {
 // field tags. A "json" tag will be used to determine the name of the field
 // and whether it is required. A "desc" tag can be used to provide a
 // description of the field. An "enum" tag can be used to provide a list of
-// possible values for the field.
+// possible values for the field, or for the elements of a slice. Tags are
+// used at any depth, in nested structs as well as structs within slices.
+//
+// A description of the struct itself can be given with a "desc" tag on a
+// blank field, "_ struct{}", which is useful for describing how the fields
+// relate to each other.
+//
+// A "requires" tag lists other fields, by their JSON names, that are required
+// whenever the tagged field is present, expressed as "dependentRequired" in
+// the schema. Tag the optional field that the others depend on, such as a
+// "custom_value" being required when "custom" is given. For conditions this
+// can't express, such as depending on the value of a field, write the schema
+// by hand and assign it to the Parameters of the returned Tool. Note that
+// strict mode doesn't support "dependentRequired", so ValidateTools reports
+// it as a problem, and the AI may not respect it.
+//
+// If the result implements io.Reader, its content is used as the output of
+// the tool, rather than its JSON representation. This lets tools pass on
+// large outputs without encoding them, up to MaxToolReaderOutput bytes.
 //
 // Example of an argument struct with field tags:
 //
 //	type args struct {
 //		Fruit         string `json:"text" desc:"your favourite fruit" enum:"apple,banana,orange"`
-//		Consumption   []int  `json:"consumption,omitempty" desc:"number of fruits eaten each day"`
+//		Consumption   []int  `json:"consumption,omitempty" desc:"number of fruits eaten each day" requires:"days"`
+//		Days          int    `json:"days,omitempty" desc:"number of days to report consumption for"`
 //	}
 func MakeTool(f any, name, desc string) Tool {
 	var t = reflect.TypeOf(f)
@@ -138,18 +320,74 @@ func MakeTool(f any, name, desc string) Tool {
 		Parameters:  string(b),
 		Handler: func(input string) (output string, err error) {
 			var v = reflect.New(t.In(0))
-			if err := json.Unmarshal([]byte(input), v.Interface()); err != nil {
+			// Numbers are kept as json.Number when decoded into an interface,
+			// rather than float64, so that large integers aren't mangled.
+			var dec = json.NewDecoder(strings.NewReader(input))
+			dec.UseNumber()
+			if err := dec.Decode(v.Interface()); err != nil {
 				return "", err
 			}
 			var results = reflect.ValueOf(f).Call([]reflect.Value{v.Elem()})
 			if !results[1].IsNil() {
 				return "", results[1].Interface().(error)
 			}
+			if r, ok := results[0].Interface().(io.Reader); ok {
+				return readToolOutput(r)
+			}
 			var b, jerr = json.MarshalIndent(results[0].Interface(), "", "  ")
-			if err != nil {
-				panic(jerr)
+			if jerr != nil {
+				return "", jerr
 			}
 			return string(b), nil
 		},
 	}
 }
+
+// ToolHandlers maps tool names to the functions handling calls to them.
+type ToolHandlers map[string]func(input string) (output string, err error)
+
+// LoadTools reads tool definitions from JSON, and binds them to handlers by
+// name. This is an alternative to MakeTool for when the set of tools is
+// defined by configuration rather than code. The JSON is a list of tool
+// definitions like this:
+//
+//	[{
+//		"name": "rollDie",
+//		"description": "Returns a random number between 1 and max.",
+//		"parameters": {
+//			"type": "object",
+//			"properties": {"max": {"type": "integer"}},
+//			"required": ["max"]
+//		}
+//	}]
+//
+// Definitions written in YAML can be converted to JSON before loading. An
+// error is returned if a tool lacks a handler, or has an invalid schema.
+func LoadTools(r io.Reader, handlers ToolHandlers) ([]Tool, error) {
+	var defs []struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description"`
+		Parameters  json.RawMessage `json:"parameters"`
+	}
+	if err := json.NewDecoder(r).Decode(&defs); err != nil {
+		return nil, fmt.Errorf("reading tool definitions: %w", err)
+	}
+	var tools []Tool
+	for _, d := range defs {
+		var h, ok = handlers[d.Name]
+		if !ok {
+			return nil, fmt.Errorf("no handler for tool %s", d.Name)
+		}
+		var t = Tool{
+			Name:        d.Name,
+			Description: d.Description,
+			Parameters:  string(d.Parameters),
+			Handler:     h,
+		}
+		if err := t.ValidateSchema(); err != nil {
+			return nil, fmt.Errorf("tool %s: %w", d.Name, err)
+		}
+		tools = append(tools, t)
+	}
+	return tools, nil
+}
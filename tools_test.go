@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/Volumental/gptease"
@@ -69,6 +71,39 @@ func TestGenerateTool(t *testing.T) {
 		return
 	}
 
+	type args3 struct {
+		Level int     `json:"level" enum:"1,2,3"`
+		Scale float32 `json:"scale" enum:"0.5,1"`
+		Flag  bool    `json:"flag" enum:"true"`
+	}
+
+	func3 := func(args args3) (int, error) { return args.Level, nil }
+
+	type leaf struct {
+		Color string `json:"color" enum:"red,green" desc:"leaf color"`
+	}
+
+	type args4 struct {
+		Tags   []string `json:"tags" enum:"a,b"`
+		Matrix [][]int  `json:"matrix" enum:"0,1"`
+		Groups []struct {
+			Leaves []leaf `json:"leaves"`
+		} `json:"groups"`
+	}
+
+	func4 := func(args args4) (int, error) { return len(args.Groups), nil }
+
+	echo := func(args map[string]any) (map[string]any, error) { return args, nil }
+
+	type args5 struct {
+		_           struct{} `desc:"A box of a standard or custom size."`
+		Kind        string   `json:"kind" enum:"small,large,custom"`
+		Custom      string   `json:"custom,omitempty" requires:"custom_unit,custom_value"`
+		CustomUnit  string   `json:"custom_unit,omitempty"`
+		CustomValue int      `json:"custom_value,omitempty"`
+	}
+	func5 := func(args args5) (string, error) { return args.Kind, nil }
+
 	tests := []struct {
 		name       string
 		f          any
@@ -171,6 +206,94 @@ func TestGenerateTool(t *testing.T) {
 			input:      `{"list": ["hello", "world"], "nested": {"qux": "foo"}}`,
 			wantOutput: `{"list": [{"num": 5}, {"num": 5}, {"num": 3}]}`,
 		},
+		{
+			name:     "numericEnums",
+			f:        func3,
+			desc:     "Function taking enums of different types.",
+			wantName: "numericEnums",
+			wantDesc: "Function taking enums of different types.",
+			wantParams: `{
+				"type": "object",
+				"properties": {
+					"level": {"type": "integer", "enum": [1, 2, 3]},
+					"scale": {"type": "number", "enum": [0.5, 1]},
+					"flag": {"type": "boolean", "enum": [true]}
+				},
+				"required": ["level", "scale", "flag"]
+			}`,
+			input:      `{"level": 2, "scale": 1, "flag": true}`,
+			wantOutput: `2`,
+		},
+		{
+			name:     "deepEnums",
+			f:        func4,
+			desc:     "Function taking enums at different depths.",
+			wantName: "deepEnums",
+			wantDesc: "Function taking enums at different depths.",
+			wantParams: `{
+				"type": "object",
+				"properties": {
+					"tags": {"type": "array", "items": {"type": "string", "enum": ["a", "b"]}},
+					"matrix": {"type": "array", "items": {"type": "array", "items": {"type": "integer", "enum": [0, 1]}}},
+					"groups": {
+						"type": "array",
+						"items": {
+							"type": "object",
+							"properties": {
+								"leaves": {
+									"type": "array",
+									"items": {
+										"type": "object",
+										"properties": {
+											"color": {"type": "string", "enum": ["red", "green"], "description": "leaf color"}
+										},
+										"required": ["color"]
+									}
+								}
+							},
+							"required": ["leaves"]
+						}
+					}
+				},
+				"required": ["tags", "matrix", "groups"]
+			}`,
+			input:      `{"tags": ["a"], "matrix": [[0, 1]], "groups": [{"leaves": [{"color": "red"}]}]}`,
+			wantOutput: `1`,
+		},
+		{
+			name:     "dependentRequired",
+			f:        func5,
+			desc:     "Function with conditionally required fields.",
+			wantName: "dependentRequired",
+			wantDesc: "Function with conditionally required fields.",
+			wantParams: `{
+				"type": "object",
+				"description": "A box of a standard or custom size.",
+				"properties": {
+					"kind": {"type": "string", "enum": ["small", "large", "custom"]},
+					"custom": {"type": "string"},
+					"custom_unit": {"type": "string"},
+					"custom_value": {"type": "integer"}
+				},
+				"required": ["kind"],
+				"dependentRequired": {"custom": ["custom_unit", "custom_value"]}
+			}`,
+			input:      `{"kind": "custom", "custom": "box", "custom_unit": "cm", "custom_value": 3}`,
+			wantOutput: `"custom"`,
+		},
+		{
+			name:     "map",
+			f:        echo,
+			desc:     "Function taking and returning a map.",
+			wantName: "map",
+			wantDesc: "Function taking and returning a map.",
+			wantParams: `{
+				"type": "object",
+				"additionalProperties": {}
+			}`,
+			input:      `{"id": 12345678901234567, "ratio": 0.5}`,
+			wantOutput: `{"id": 12345678901234567, "ratio": 0.5}`,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -193,3 +316,226 @@ func TestGenerateTool(t *testing.T) {
 		})
 	}
 }
+
+func TestToolNumbers(t *testing.T) {
+	var tool = gptease.MakeTool(
+		func(args map[string]any) (map[string]any, error) { return args, nil },
+		"echo", "Echoes its arguments.",
+	)
+	got, err := tool.Handler(`{"id": 12345678901234567, "count": 1000000}`)
+	if err != nil {
+		t.Fatalf("Handler error = %v", err)
+	}
+	for _, want := range []string{"12345678901234567", "1000000"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Handler output = %s, want it to contain %s", got, want)
+		}
+	}
+}
+
+func TestValidateSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  string
+		wantErr bool
+	}{
+		{"empty", `{"type": "object", "properties": {}}`, false},
+		{"generated", gptease.MakeTool(func(struct {
+			A []string `json:"a" enum:"x,y"`
+			B struct {
+				C float32 `json:"c,omitempty"`
+			} `json:"b"`
+		}) (int, error) {
+			return 0, nil
+		}, "f", "").Parameters, false},
+		{"invalid json", `{"type": `, true},
+		{"unknown type", `{"type": "float"}`, true},
+		{"missing required", `{"type": "object", "properties": {"a": {"type": "string"}}, "required": ["b"]}`, true},
+		{"array without items", `{"type": "object", "properties": {"a": {"type": "array"}}}`, true},
+		{"nested", `{"type": "object", "properties": {"a": {"type": "array", "items": {"type": "strin"}}}}`, true},
+		{"empty enum", `{"type": "string", "enum": []}`, true},
+		{"integer enum", `{"type": "integer", "enum": [1, 2, 3]}`, false},
+		{"mismatched enum", `{"type": "integer", "enum": ["1", "2"]}`, true},
+		{"fractional enum", `{"type": "integer", "enum": [1.5]}`, true},
+		{"dependent required", `{"type": "object", "properties": {"a": {"type": "string"}, "b": {"type": "string"}}, "dependentRequired": {"a": ["b"]}}`, false},
+		{"missing dependent required", `{"type": "object", "properties": {"a": {"type": "string"}}, "dependentRequired": {"a": ["b"]}}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tool = gptease.Tool{Name: tt.name, Parameters: tt.params}
+			if err := tool.ValidateSchema(); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateSchema() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestToolReader(t *testing.T) {
+	var tool = gptease.MakeTool(
+		func(n int) (io.Reader, error) { return strings.NewReader(strings.Repeat("x", n)), nil },
+		"xs", "Returns n x's.",
+	)
+	if got, err := tool.Handler("3"); err != nil || got != "xxx" {
+		t.Errorf("Handler() = %q, %v, want %q", got, err, "xxx")
+	}
+
+	defer func(n int64) { gptease.MaxToolReaderOutput = n }(gptease.MaxToolReaderOutput)
+	gptease.MaxToolReaderOutput = 5
+	if got, err := tool.Handler("10"); err != nil || !strings.HasPrefix(got, "xxxxx\n") {
+		t.Errorf("Handler() = %q, %v, want truncated output", got, err)
+	}
+}
+
+func TestLoadTools(t *testing.T) {
+	const defs = `[{
+		"name": "shout",
+		"description": "Makes text louder.",
+		"parameters": {"type": "object", "properties": {"text": {"type": "string"}}, "required": ["text"]}
+	}]`
+	var handlers = gptease.ToolHandlers{
+		"shout": func(input string) (string, error) { return strings.ToUpper(input), nil },
+	}
+	tools, err := gptease.LoadTools(strings.NewReader(defs), handlers)
+	if err != nil {
+		t.Fatalf("LoadTools() error = %v", err)
+	}
+	if len(tools) != 1 || tools[0].Name != "shout" || tools[0].Description != "Makes text louder." {
+		t.Fatalf("LoadTools() = %+v", tools)
+	}
+	if got, _ := tools[0].Handler(`{"text": "hi"}`); got != `{"TEXT": "HI"}` {
+		t.Errorf("Handler() = %q", got)
+	}
+
+	if _, err := gptease.LoadTools(strings.NewReader(defs), gptease.ToolHandlers{}); err == nil {
+		t.Errorf("LoadTools() without handler error = nil, want error")
+	}
+	const invalid = `[{"name": "shout", "parameters": {"type": "text"}}]`
+	if _, err := gptease.LoadTools(strings.NewReader(invalid), handlers); err == nil {
+		t.Errorf("LoadTools() with invalid schema error = nil, want error")
+	}
+}
+
+type celsius float64
+
+func (c celsius) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("%g°C", float64(c)))
+}
+
+func TestCheckToolRoundTrip(t *testing.T) {
+	type args struct {
+		Name  string            `json:"name" enum:"a,b"`
+		Tags  []string          `json:"tags"`
+		Extra map[string]any    `json:"extra"`
+		Sizes map[string]uint16 `json:"sizes"`
+	}
+	var tool = gptease.MakeTool(func(args) (int, error) { return 0, nil }, "f", "")
+	var sample = args{
+		Name:  "a",
+		Tags:  []string{"x"},
+		Extra: map[string]any{"n": 1.5},
+		Sizes: map[string]uint16{"left": 42},
+	}
+	if err := gptease.CheckToolRoundTrip(tool, sample); err != nil {
+		t.Errorf("CheckToolRoundTrip() = %v", err)
+	}
+	sample.Name = "c"
+	if err := gptease.CheckToolRoundTrip(tool, sample); err == nil {
+		t.Errorf("CheckToolRoundTrip() with invalid enum = nil, want error")
+	}
+
+	// A celsius is marshaled as a string, which doesn't match the schema
+	// generated from the underlying type.
+	type temperature struct {
+		C celsius `json:"c"`
+	}
+	tool = gptease.MakeTool(func(temperature) (int, error) { return 0, nil }, "f", "")
+	if err := gptease.CheckToolRoundTrip(tool, temperature{C: 21}); err == nil {
+		t.Errorf("CheckToolRoundTrip() with custom marshaling = nil, want error")
+	}
+}
+
+func TestValidateTools(t *testing.T) {
+	var handler = func(string) (string, error) { return "", nil }
+	var valid = gptease.MakeTool(func(struct {
+		A string `json:"a"`
+	}) (int, error) {
+		return 0, nil
+	}, "valid", "")
+	var chat = gptease.Chat{Tools: []gptease.Tool{valid}}
+	if err := chat.ValidateTools(); err != nil {
+		t.Errorf("ValidateTools() = %v, want nil", err)
+	}
+
+	var deep = `{"type": "string"}`
+	for i := 0; i < 11; i++ {
+		deep = `{"type": "object", "properties": {"a": ` + deep + `}}`
+	}
+	chat.Tools = []gptease.Tool{
+		valid,
+		valid,
+		{Name: "bad name", Parameters: `{"type": "object"}`, Handler: handler},
+		{Name: "string", Parameters: `{"type": "string"}`, Handler: handler},
+		{Name: "deep", Parameters: deep, Handler: handler},
+		{Name: "broken", Parameters: `{"type": "float"}`, Handler: handler},
+	}
+	var errs gptease.SchemaErrors
+	if err := chat.ValidateTools(); !errors.As(err, &errs) || len(errs) != 5 {
+		t.Errorf("ValidateTools() = %v, want 5 problems", err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		schema  string
+		keyword string
+	}{
+		{"dependentRequired", `{"type": "object", "properties": {"a": {"type": "string"}, "b": {"type": "string"}}, "dependentRequired": {"a": ["b"]}}`, "dependentRequired"},
+		{"patternProperties", `{"type": "object", "patternProperties": {"^x_": {"type": "string"}}}`, "patternProperties"},
+		{"minLength", `{"type": "object", "properties": {"a": {"type": "string", "minLength": 1}}}`, "minLength"},
+		{"pattern in items", `{"type": "object", "properties": {"a": {"type": "array", "items": {"type": "string", "pattern": "^a"}}}}`, "pattern"},
+		{"maximum", `{"type": "object", "properties": {"a": {"type": "integer", "maximum": 10}}}`, "maximum"},
+		{"keyword as property name", `{"type": "object", "properties": {"pattern": {"type": "string"}}}`, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var chat = gptease.Chat{Tools: []gptease.Tool{{Name: "tool", Parameters: tt.schema, Handler: handler}}}
+			var err = chat.ValidateTools()
+			if tt.keyword == "" {
+				if err != nil {
+					t.Errorf("ValidateTools() = %v, want nil", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.keyword+" is not supported") {
+				t.Errorf("ValidateTools() = %v, want %s rejected", err, tt.keyword)
+			}
+		})
+	}
+}
+
+func TestRepairToolArguments(t *testing.T) {
+	for _, repair := range []bool{true, false} {
+		newFakeAPI(t,
+			`{"choices": [{"message": {"role": "assistant", "tool_calls": [
+				{"id": "call_1", "type": "function", "function": {"name": "double", "arguments": "{\"n\": 21,}"}}
+			]}, "finish_reason": "tool_calls"}]}`,
+			`{"choices": [{"message": {"role": "assistant", "content": "Done."}, "finish_reason": "stop"}]}`,
+		)
+		var called bool
+		var chat = gptease.Chat{
+			Tools: []gptease.Tool{gptease.MakeTool(func(args struct {
+				N int `json:"n"`
+			}) (int, error) {
+				called = true
+				return 2 * args.N, nil
+			}, "double", "Doubles a number.")},
+			RepairToolArguments: repair,
+		}
+		if _, err := chat.Exchange("Double 21."); err != nil {
+			t.Fatalf("Exchange() error = %v", err)
+		}
+		var result = chat.Dialogue[2].Content
+		if repair && (!called || result != "42") {
+			t.Errorf("with repair, called = %v, result = %q, want 42", called, result)
+		}
+		if !repair && (called || result == "42") {
+			t.Errorf("without repair, called = %v, result = %q, want an error", called, result)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package gptease
+
+import (
+	"reflect"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// ConversationTree keeps track of alternative versions of a conversation,
+// for example when regenerating a response or editing an earlier message.
+// Each path from the root to a node is a dialogue, and one of them is active
+// at any time.
+//
+// A typical way to use it is to set the Dialogue of a Chat to the active
+// dialogue of the tree, let the chat talk, and Record the result.
+type ConversationTree struct {
+	root   TreeNode
+	active *TreeNode
+}
+
+// TreeNode is a message in a ConversationTree.
+type TreeNode struct {
+	Message  openai.ChatCompletionMessage
+	parent   *TreeNode
+	children []*TreeNode
+}
+
+// Parent returns the node preceding this one, or nil for the first message.
+func (n *TreeNode) Parent() *TreeNode {
+	if n.parent == nil || n.parent.parent == nil {
+		// The root node is not a message.
+		return nil
+	}
+	return n.parent
+}
+
+// NewConversationTree creates a tree with a single branch, which is active.
+func NewConversationTree(d Dialogue) *ConversationTree {
+	var t = &ConversationTree{}
+	t.active = &t.root
+	for _, m := range d {
+		t.Add(m)
+	}
+	return t
+}
+
+func (t *ConversationTree) init() {
+	if t.active == nil {
+		t.active = &t.root
+	}
+}
+
+// Active returns the last node of the active dialogue, or nil if empty.
+func (t *ConversationTree) Active() *TreeNode {
+	t.init()
+	if t.active == &t.root {
+		return nil
+	}
+	return t.active
+}
+
+// Dialogue returns the active dialogue.
+func (t *ConversationTree) Dialogue() Dialogue {
+	t.init()
+	var d Dialogue
+	for n := t.active; n != &t.root; n = n.parent {
+		d = append(d, n.Message)
+	}
+	for i, j := 0, len(d)-1; i < j; i, j = i+1, j-1 {
+		d[i], d[j] = d[j], d[i]
+	}
+	return d
+}
+
+// Add adds a message at the end of the active dialogue.
+func (t *ConversationTree) Add(msg openai.ChatCompletionMessage) *TreeNode {
+	t.init()
+	return t.Branch(t.active, msg)
+}
+
+// Branch adds a message after the given node, starting a new branch if the
+// node already has a following message. Use nil to add an alternative first
+// message. The new branch becomes active.
+func (t *ConversationTree) Branch(at *TreeNode, msg openai.ChatCompletionMessage) *TreeNode {
+	if at == nil {
+		at = &t.root
+	}
+	var n = &TreeNode{Message: msg, parent: at}
+	at.children = append(at.children, n)
+	t.active = n
+	return n
+}
+
+// Branches returns the alternative messages following a node, in the order
+// they were added. Use nil to get the alternative first messages.
+func (t *ConversationTree) Branches(at *TreeNode) []*TreeNode {
+	if at == nil {
+		at = &t.root
+	}
+	return append([]*TreeNode(nil), at.children...)
+}
+
+// Switch makes the branch containing the node active. The active dialogue
+// then continues past the node to the end of its most recently added branch.
+func (t *ConversationTree) Switch(n *TreeNode) {
+	if n == nil {
+		n = &t.root
+	}
+	for len(n.children) > 0 {
+		n = n.children[len(n.children)-1]
+	}
+	t.active = n
+}
+
+// Record makes a dialogue the active one, reusing the nodes of any messages
+// it has in common with the active dialogue, and branching off where it
+// starts to differ. This is useful for recording the changes made to a
+// dialogue by a Chat.
+func (t *ConversationTree) Record(d Dialogue) {
+	t.init()
+	var path = t.Dialogue()
+	var n = &t.root
+	var i int
+	for ; i < len(d) && i < len(path) && reflect.DeepEqual(d[i], path[i]); i++ {
+		n = t.nodeAt(i)
+	}
+	t.active = n
+	for _, m := range d[i:] {
+		t.Add(m)
+	}
+}
+
+// nodeAt returns the node at a position in the active dialogue.
+func (t *ConversationTree) nodeAt(i int) *TreeNode {
+	var depth int
+	for n := t.active; n != &t.root; n = n.parent {
+		depth++
+	}
+	var n = t.active
+	for ; depth > i+1; depth-- {
+		n = n.parent
+	}
+	return n
+}
@@ -0,0 +1,59 @@
+package gptease_test
+
+import (
+	"testing"
+
+	"github.com/Volumental/gptease"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func contents(d gptease.Dialogue) []string {
+	var s []string
+	for _, m := range d {
+		s = append(s, m.Content)
+	}
+	return s
+}
+
+func TestConversationTree(t *testing.T) {
+	var user = func(s string) openai.ChatCompletionMessage {
+		return openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: s}
+	}
+	var ai = func(s string) openai.ChatCompletionMessage {
+		return openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: s}
+	}
+
+	var tree = gptease.NewConversationTree(gptease.Dialogue{user("Hi")})
+	var hi = tree.Active()
+	var hello = tree.Add(ai("Hello"))
+	tree.Add(user("Bye"))
+
+	// Regenerate the response to "Hi".
+	tree.Branch(hi, ai("Ahoy"))
+	if got := contents(tree.Dialogue()); len(got) != 2 || got[1] != "Ahoy" {
+		t.Errorf("Dialogue() = %v, want [Hi Ahoy]", got)
+	}
+	if n := len(tree.Branches(hi)); n != 2 {
+		t.Errorf("len(Branches()) = %d, want 2", n)
+	}
+
+	// Switch back to the first response, continuing to its end.
+	tree.Switch(hello)
+	if got := contents(tree.Dialogue()); len(got) != 3 || got[2] != "Bye" {
+		t.Errorf("Dialogue() = %v, want [Hi Hello Bye]", got)
+	}
+
+	// Record an edited version of the last message.
+	var d = tree.Dialogue()
+	d[2] = user("See you")
+	tree.Record(d)
+	if got := contents(tree.Dialogue()); len(got) != 3 || got[2] != "See you" {
+		t.Errorf("Dialogue() = %v, want [Hi Hello See you]", got)
+	}
+	if n := len(tree.Branches(hello)); n != 2 {
+		t.Errorf("len(Branches()) = %d, want 2", n)
+	}
+	if tree.Active().Parent() != hello || hi.Parent() != nil {
+		t.Errorf("Parent() not as expected")
+	}
+}